@@ -0,0 +1,87 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/opusparser"
+)
+
+// RFC 6381 codec string for a single stream, or empty if unknown
+func codecString(stream av.CodecData) string {
+	switch cd := stream.(type) {
+	case h264parser.CodecData:
+		ri := cd.RecordInfo
+		return fmt.Sprintf("avc1.%02x%02x%02x", ri.AVCProfileIndication, ri.ProfileCompatibility, ri.AVCLevelIndication)
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", cd.Config.ObjectType)
+	case opusparser.CodecData, *opusparser.CodecData:
+		return "opus"
+	case interface{ CodecString() string }:
+		// codec data from elsewhere can describe itself
+		return cd.CodecString()
+	case interface{ AVCDecoderConfRecordBytes() []byte }:
+		// HEVC codec data carries a decoder configuration record in the same way as H.264
+		if t := stream.Type().String(); t == "H265" || t == "HEVC" {
+			return hevcCodecString(cd.AVCDecoderConfRecordBytes())
+		}
+	}
+	return ""
+}
+
+// RFC 6381 codec string from an HEVCDecoderConfigurationRecord, per ISO/IEC 14496-15 Annex E
+func hevcCodecString(rec []byte) string {
+	if len(rec) < 13 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if space := rec[1] >> 6; space != 0 {
+		b.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&b, "%d.", rec[1]&0x1f)
+	// compatibility flags are written in reverse bit order
+	compat := uint32(rec[2])<<24 | uint32(rec[3])<<16 | uint32(rec[4])<<8 | uint32(rec[5])
+	var rev uint32
+	for i := 0; i < 32; i++ {
+		rev = rev<<1 | compat&1
+		compat >>= 1
+	}
+	fmt.Fprintf(&b, "%x.", rev)
+	if rec[1]&0x20 != 0 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", rec[12])
+	// constraint flags, omitting trailing zero bytes
+	constraints := rec[6:12]
+	for len(constraints) != 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// comma-separated codec strings for all known streams
+func codecsString(streams []av.CodecData) string {
+	var codecs []string
+	for _, cd := range streams {
+		if c := codecString(cd); c != "" {
+			codecs = append(codecs, c)
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
+// Codecs returns the RFC 6381 codec string for the stream, as used in the CODECS attribute of a multivariant playlist.
+// It is empty until the first segment starts, or if no codec could be identified.
+func (p *Publisher) Codecs() string {
+	state, _ := p.state.Load().(hlsState)
+	return state.info.codecs
+}
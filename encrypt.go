@@ -0,0 +1,92 @@
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encryption configures AES-128 encryption of MPEG-TS segments
+type Encryption struct {
+	// Key is the 16 byte AES-128 key
+	Key []byte
+	// KeyURI is where clients fetch the key from
+	KeyURI string
+	// IV is an optional fixed 16 byte initialization vector.
+	// If empty, each segment's IV is derived from its media sequence number.
+	IV []byte
+	// KeyName, if set, is a file name under which ServeHTTP serves the key itself
+	KeyName string
+}
+
+func (e *Encryption) block() (cipher.Block, error) {
+	if len(e.Key) != aes.BlockSize {
+		return nil, errors.New("encryption key must be 16 bytes")
+	}
+	if len(e.IV) != 0 && len(e.IV) != aes.BlockSize {
+		return nil, errors.New("encryption IV must be 16 bytes")
+	}
+	return aes.NewCipher(e.Key)
+}
+
+// initialization vector for the segment with the given media sequence number
+func (e *Encryption) segmentIV(seq int64) []byte {
+	if len(e.IV) != 0 {
+		return e.IV
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// m3u8 key tag for the segment with the given media sequence number
+func (e *Encryption) keyTag(seq int64) string {
+	return fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"%s\",IV=0x%x\n", e.KeyURI, e.segmentIV(seq))
+}
+
+// cbcWriter encrypts a segment with AES-128-CBC and PKCS7 padding
+type cbcWriter struct {
+	w    io.Writer
+	mode cipher.BlockMode
+	buf  []byte
+	out  []byte
+}
+
+func newCBCWriter(w io.Writer, block cipher.Block, iv []byte) *cbcWriter {
+	return &cbcWriter{w: w, mode: cipher.NewCBCEncrypter(block, iv)}
+}
+
+// encrypt and write out all complete blocks, holding the remainder until the next write
+func (c *cbcWriter) Write(d []byte) (int, error) {
+	c.buf = append(c.buf, d...)
+	full := len(c.buf) - len(c.buf)%aes.BlockSize
+	if full == 0 {
+		return len(d), nil
+	}
+	if cap(c.out) < full {
+		c.out = make([]byte, full)
+	}
+	out := c.out[:full]
+	c.mode.CryptBlocks(out, c.buf[:full])
+	c.buf = append(c.buf[:0], c.buf[full:]...)
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// Close pads and writes the final block
+func (c *cbcWriter) Close() error {
+	pad := aes.BlockSize - len(c.buf)
+	for i := 0; i < pad; i++ {
+		c.buf = append(c.buf, byte(pad))
+	}
+	out := make([]byte, aes.BlockSize)
+	c.mode.CryptBlocks(out, c.buf)
+	c.buf = c.buf[:0]
+	_, err := c.w.Write(out)
+	return err
+}
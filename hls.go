@@ -2,46 +2,358 @@ package hls
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"eaglesong.dev/hls/internal/adtsfrag"
 	"eaglesong.dev/hls/internal/fmp4"
 	"eaglesong.dev/hls/internal/tsfrag"
 	"github.com/nareix/joy4/av"
 )
 
-// Publisher implements a live HLS stream server
+// Publisher implements a live HLS stream server.
+//
+// Packets may be written from any goroutine, one call at a time being processed. ServeHTTP may be called concurrently
+// with writing. Exported configuration fields must be set before WriteHeader and not modified afterwards.
 type Publisher struct {
+	// 64-bit atomics must be at the start of the struct for alignment
+	stats counters
+
 	// InitialDuration is a guess for the TARGETDURATION field in the playlist, used until the first segment is complete
 	InitialDuration time.Duration
+	// WallClockWeight blends the time segments took to arrive into their advertised durations, for sources whose
+	// timestamps drift from real time. 0 uses only packet timestamps and 1 uses only arrival time.
+	// Partial segment durations always use packet timestamps.
+	WallClockWeight float64
+	// MaxGap, if set, inserts a discontinuity before the next segment when packets stop arriving for longer than this,
+	// or when consecutive packets in a stream are further apart than this
+	MaxGap time.Duration
+	// RebaseTimestamps shifts packet timestamps so that the stream starts shortly after zero rather than at the
+	// source's arbitrary time base. The same offset applies to every segment until the stream restarts after a
+	// change of streams, a backwards timestamp jump or a call to Discontinuity, when it is recalculated to continue
+	// from the previous packet.
+	// Program date-times are unaffected since they don't derive from packet timestamps. Each publisher rebases
+	// independently, so it must not be used with audio renditions or subtitles that need to line up with the video.
+	RebaseTimestamps bool
+	// AcceptRecoveryPoints lets H.264 frames flagged as keyframes start a segment if they carry a recovery point SEI
+	// message. By default only IDR frames do, since segments starting elsewhere may not be independently decodable.
+	AcceptRecoveryPoints bool
+	// MinSegmentDuration is the shortest a segment can be. Keyframes arriving sooner than this after the start of
+	// the current segment are muxed into it rather than starting a new one.
+	MinSegmentDuration time.Duration
+	// MaxSegmentDuration, if set, forces a new segment to start once the current one reaches this duration even if no
+	// keyframe has arrived. This also starts the first segment if the source never sends keyframes.
+	// Segments cut this way may not be independently decodable.
+	MaxSegmentDuration time.Duration
+	// TargetSegmentDuration, if set, is the segment length to aim for regardless of the source's keyframe interval.
+	// Short GOPs are merged until the segment is as close to the target as the next expected keyframe would bring it,
+	// so that a 0.5 second GOP gives segments of about the target length rather than one segment per keyframe.
+	TargetSegmentDuration time.Duration
+	// SplitLongGOPs cuts segments that reach TargetSegmentDuration without a keyframe, marking the next one with a
+	// discontinuity. Players then reset their decoder between frames that depend on each other, so there will be a
+	// glitch until the next keyframe, but segments stay close to the target with sources sending a keyframe only
+	// every 10 seconds or so.
+	SplitLongGOPs bool
+	// KeyframeTimeout, if set, causes WritePacket to return ErrNoKeyframe once if packets spanning this duration are
+	// received without a keyframe to start the first segment. Later packets are accepted as usual.
+	KeyframeTimeout time.Duration
 	// BufferLength is the approximate duration spanned by all the segments in the playlist. Old segments are removed until the playlist length is less than this value.
 	BufferLength time.Duration
+	// SegmentMaxAge is the max-age sent in Cache-Control headers for segments, which never change once published.
+	// Defaults to BufferLength.
+	SegmentMaxAge time.Duration
 	// WorkDir is a temporary storage location for segments. Can be empty, in which case the default system temp dir is used.
 	WorkDir string
+	// WorkDirFallback uses the system temp dir if WorkDir turns out not to be writable, instead of WriteHeader
+	// returning an error
+	WorkDirFallback bool
+	// WorkDirPrefix is prepended to the names of segment files in WorkDir, followed by a dash.
+	// Giving each stream a distinct, stable prefix lets CleanupWorkDir remove files left by an earlier run of the same stream.
+	WorkDirPrefix string
+	// MinSegments is the fewest segments kept in a live playlist regardless of BufferLength. Defaults to 10.
+	// Players typically buffer three target durations from the live edge before starting, so fewer than about 4
+	// segments risks stalls.
+	MinSegments int
+	// MaxSegments, if set, is the most segments kept in a live playlist regardless of BufferLength
+	MaxSegments int
+	// MaxDiskBytes, if set, removes the oldest segments from a live playlist once the segments it holds exceed this
+	// size, even if they are within BufferLength
+	MaxDiskBytes int64
+	// InMemory keeps segments in RAM instead of WorkDir. Memory use is bounded by BufferLength.
+	InMemory bool
+	// Store is a storage backend for segments, overriding WorkDir and InMemory
+	Store SegmentStore
+	// WriteQueue, if set, stores segment data from a background goroutine with up to this many writes pending, so that
+	// slow storage doesn't hold up the caller of WritePacket. Completing a segment or part still waits for the queue to
+	// drain. When the queue is full WritePacket blocks, unless DropOnFullQueue is set, in which case the rest of the
+	// segment is discarded and it is marked as a gap.
+	WriteQueue      int
+	DropOnFullQueue bool
 	// Prefetch indicates that low-latency HLS (LHLS) tags should be used
 	// https://github.com/video-dev/hlsjs-rfcs/blob/a6e7cc44294b83a7dba8c4f45df6d80c4bd13955/proposals/0001-lhls.md
 	Prefetch  bool
 	Precreate int
+	// PartDuration enables low-latency HLS partial segments, cut approximately this often
+	// https://developer.apple.com/documentation/http_live_streaming/enabling_low-latency_hls
+	PartDuration time.Duration
+	// PartHoldBack is how far from the end of the playlist low-latency players should start, advertised in
+	// EXT-X-SERVER-CONTROL when PartDuration is set. It must be at least twice PartDuration, and defaults to three times.
+	PartHoldBack time.Duration
+	// HoldBack is how far from the end of the playlist players not using partial segments should start.
+	// It must be at least three target durations, and defaults to that; if the target duration grows beyond a
+	// third of HoldBack, the minimum is advertised instead.
+	HoldBack time.Duration
+	// PartByteRanges lists partial segments as byte ranges of their parent segment instead of as separate files.
+	// Preload hints for the next part are only given when parts are separate files.
+	PartByteRanges bool
+	// PartLookahead lets a client add ?lookahead=1 to a partial segment request to receive everything from the start
+	// of that part to the end of its parent segment in one response, flushed as each part completes. Following the
+	// preload hint this way saves a blocking request per part.
+	PartLookahead bool
+	// ProgramDateTime tags every segment with its wall-clock time, for packets that don't provide one via ExtendedPacket.
+	// The first segment is stamped with the current time, and subsequent ones advance by the preceding segment's duration.
+	ProgramDateTime bool
+	// Now is used everywhere the publisher reads the wall clock, e.g. for program date-times, staleness and segment
+	// names, so that tests can control it. Defaults to time.Now. It may be called concurrently.
+	Now func() time.Time
+	// Loop keeps the playlist live after WriteTrailer by replaying the buffered segments over and over, e.g. for
+	// signage, rather than ending it. Each pass begins with a discontinuity, which tells players that timestamps jump
+	// back to those of the first segment, so the source needs no special timestamp handling; program date-times are
+	// re-anchored to the wall clock at each pass. Only what is still buffered is replayed, so BufferLength must cover
+	// the whole content. Replayed segments have no partial segments or I-frames listed. Writing a new header or
+	// packet stops the loop.
+	Loop bool
+	// Logger, if set, is told about segments starting and expiring, discontinuities and write errors
+	Logger Logger
+	// Container selects the segment format. The default is MPEG2-TS, which carries H.264 and AAC only;
+	// WriteHeader returns an error for other codecs such as Opus, which require fMP4.
+	Container Container
+	// TargetDurationStrategy selects how the playlist's target duration is derived from its segments
+	TargetDurationStrategy TargetStrategy
+	// PSIInterval, if set, repeats the PAT and PMT within MPEG-TS segments this often, in addition to the start of
+	// every segment. This lets players and set-top boxes tune in part way through a long segment, at the cost of
+	// two extra 188 byte packets each time.
+	PSIInterval time.Duration
 	// FMP4 enables use of Fragmented MP4 segments instead of the traditional MPEG2-TS
+	//
+	// Deprecated: set Container to ContainerFMP4
 	FMP4 bool
+	// AllowCORS adds CORS headers to all responses so browser-based players on other origins can load the stream.
+	// If AllowedOrigins is empty then any origin is allowed.
+	AllowCORS      bool
+	AllowedOrigins []string
+	// Encryption enables AES-128 encryption of MPEG-TS segments
+	Encryption *Encryption
+	// OnSegmentComplete is called after each segment is finalized, from the goroutine writing packets.
+	// It must return quickly; slow work such as uploading should be handed off to another goroutine.
+	// It must not call the publisher's writing methods.
+	OnSegmentComplete func(SegmentInfo)
+	// Sink, if set, is handed each segment once it is complete, from the goroutine writing packets, instead of the
+	// publisher keeping a playlist. Segments are held in memory only until they have been passed to Sink, so WorkDir,
+	// Store and ServeHTTP are not used. An error from Sink is returned by the write that completed the segment.
+	// fMP4 segments can't be decoded without the init segment, so sinks normally use MPEG-TS.
+	Sink func(SegmentInfo, io.Reader) error
+	// Recorder, if set, also records the stream to MP4 files
+	Recorder *Recorder
+	// IndependentSegments always adds EXT-X-INDEPENDENT-SEGMENTS to the playlist, for sources known to start every
+	// segment with a decodable frame. Otherwise the tag is added only while every segment starts on a video keyframe.
+	IndependentSegments bool
+	// IFramePlaylist serves an I-frame only playlist for trick play as iframes.m3u8.
+	// It is only available for unencrypted MPEG-TS segments with a video stream.
+	IFramePlaylist bool
+	// SegmentNameFunc, if set, names each segment after its media sequence number. It returns the name without an
+	// extension, e.g. fmt.Sprintf("seg-%05d", seq), and must not reuse the name of a segment still in the playlist.
+	// Names containing a slash, a backslash or ".." are rejected.
+	// By default segments are given unique names derived from the time the stream started.
+	SegmentNameFunc func(seq int64) string
+	// DeterministicNames numbers segments from SegmentSeed instead of from the time the stream started, so that names
+	// are reproducible. Names still never repeat within the life of the publisher, but a restarted stream reuses
+	// them, so caches must not outlive the stream unless each run is given a distinct seed.
+	DeterministicNames bool
+	SegmentSeed        int64
+	// PrimeSegments is how many of the most recent segments are considered to be at the live edge, where new viewers
+	// join, rather than in the DVR tail. If set, edge segments are served with an X-Live-Edge header so that CDNs can
+	// be configured to keep them hot. Defaults to 3 for SegmentInfo.LiveEdge.
+	PrimeSegments int
+	// SegmentHeaders adds X-Media-Sequence and X-Segment-Duration headers to segment responses, and X-Part-Index and
+	// X-Part-Duration to partial segments, so that request logs can be matched up with playlist entries. Durations
+	// are only sent once known.
+	SegmentHeaders bool
+	// PreloadHints adds Link preload headers for the init segment and live edge segments to playlist responses, which
+	// CDNs can turn into 103 Early Hints. Where the connection supports HTTP/2 server push they are also pushed,
+	// which happens on every playlist reload, so it suits short playlists with few edge segments.
+	PreloadHints bool
+	// NotFoundBeforeStart returns 404 for requests arriving before the first segment has started.
+	// By default such requests get 503 with Retry-After so players keep polling until media is available.
+	NotFoundBeforeStart bool
+	// MinValidSegmentBytes marks segments smaller than this with EXT-X-GAP so players skip them.
+	// Segments containing no media are always marked.
+	MinValidSegmentBytes int64
+	// StaleAfter, if set, makes ServeHTTP respond to playlist requests with 503 once no segment has started for this
+	// many target durations, so that load balancers can detect a stream whose source has died and fail over.
+	// Ended playlists are never stale.
+	StaleAfter int
+	// InitialSequence and InitialDiscontinuitySequence are the media and discontinuity sequence numbers to start from.
+	// A restarted stream should resume from where the previous run left off, e.g. one more than the Sequence of the
+	// last segment and one more than the discontinuity sequence, so that clients and caches holding the old playlist
+	// never see the sequence go backwards.
+	InitialSequence              int64
+	InitialDiscontinuitySequence int64
+	// SegmentBitrate tags each complete segment with its bitrate using EXT-X-BITRATE, which players may use to improve
+	// adaptive bitrate decisions. This requires version 8 of the protocol.
+	SegmentBitrate bool
+	// DebugDiscontinuityEvery, if set, marks every Nth segment as a discontinuity even though the stream is continuous.
+	// It is meant for testing how players and CDNs handle discontinuities, and should not be used in production.
+	DebugDiscontinuityEvery int
+	// PlaylistFile is the file name the playlist is served as. Defaults to index.m3u8.
+	PlaylistFile string
+	// PlaylistContentType is the Content-Type playlists are served with. Defaults to application/vnd.apple.mpegurl.
+	// Only change it for clients or CDNs known to need something else, such as audio/mpegurl, since many players
+	// refuse a playlist with an unexpected type.
+	PlaylistContentType string
+	// MasterFile, if set, is a file name under which a multivariant playlist is served with the media playlist as its
+	// only variant, e.g. "master.m3u8", for players that insist on one. MasterPlaylist is needed for more renditions.
+	MasterFile string
+	// Version overrides the EXT-X-VERSION of the media playlist, which by default is the lowest supporting the tags in use
+	Version int
+	// StartOffset, if set, tells players where to start playback with EXT-X-START.
+	// Positive offsets are from the start of the playlist and negative ones from the end, e.g. -10s starts near the live edge.
+	StartOffset time.Duration
+	// PlaylistType is empty for a live sliding-window playlist, or one of PlaylistEvent or PlaylistVOD.
+	// Segments are never removed from EVENT and VOD playlists.
+	PlaylistType string
 
 	segments []*segment
 	presegs  []*segment
 	segNum   int64
+	seeded   bool
 	seq      int64
 	dcn      bool
 	dcnseq   int64
 	state    atomic.Value
 
+	targetDur time.Duration
+	ended     bool
+	info      streamInfo
+	block     cipher.Block
+	enc       *cbcWriter
+	changed   chan struct{}
+	lastTime  time.Duration
+
+	// guards writer state
+	mu sync.Mutex
+	// sibling renditions in a multivariant playlist, as []peer
+	peers atomic.Value
+
+	// pending and current ad break
+	cueOut     time.Duration
+	cueIn      bool
+	inBreak    bool
+	breakStart time.Duration
+	breakDur   time.Duration
+
+	subMu      sync.Mutex
+	subs       []chan PlaylistUpdate
+	subsClosed bool
+
+	serveMu  sync.Mutex
+	inflight sync.WaitGroup
+	closing  bool
+	shutdown chan struct{}
+
+	waiting   bool
+	waitStart time.Duration
+	keyWarned bool
+	plbuf     bytes.Buffer
+	gz        *gzip.Writer
+	lastTimes []time.Duration
+	arrival   time.Time
+	step      time.Duration
+
+	// time of the last keyframe and interval before it, for TargetSegmentDuration
+	prevKey time.Duration
+	gop     time.Duration
+
+	// offset subtracted from packet timestamps by RebaseTimestamps
+	tsOffset time.Duration
+	rebased  bool
+	retime   bool
+
+	// WorkDir wasn't writable, so the system temp dir is used instead
+	noWorkDir bool
+	// sequence numbering has been set up, by WriteHeader or PushSegment
+	started bool
+	// closed to stop replaying segments for Loop
+	loopStop chan struct{}
+
 	vidx    int
+	aidx    int
+	h264    bool
 	current *segment
+	initSeg *initSegment
 	frag    fragmenter
+	queue   *writeQueue
 }
 
+// ErrNoKeyframe is returned by WritePacket when Publisher.KeyframeTimeout elapses without a keyframe
+var ErrNoKeyframe = errors.New("no keyframe received; playlist is empty")
+
+// ErrEnded is returned by WritePacket after WriteTrailer has ended an EVENT or VOD playlist
+var ErrEnded = errors.New("playlist has ended")
+
+// Container is a segment format
+type Container int
+
+// segment formats for Publisher.Container
+const (
+	// ContainerTS produces MPEG2-TS segments
+	ContainerTS Container = iota
+	// ContainerFMP4 produces CMAF-compatible Fragmented MP4 segments, with an init segment referenced by EXT-X-MAP.
+	// The init segment is named after a hash of its contents, so a change of codecs gives it a new URL.
+	ContainerFMP4
+	// ContainerPackedAudio produces packed audio segments of ADTS frames, for streams consisting of a single AAC stream.
+	// They are smaller than MPEG-TS, which matters for low bitrate streams such as radio.
+	ContainerPackedAudio
+)
+
+// TargetStrategy is a way of choosing the target duration
+type TargetStrategy int
+
+// strategies for Publisher.TargetDurationStrategy
+const (
+	// TargetMax uses the longest segment, so one unusually long segment raises the target for as long as it is listed
+	TargetMax TargetStrategy = iota
+	// TargetPercentile uses the 95th percentile of segment durations, once there are enough segments for that to
+	// differ from the longest. A segment completing longer than that is marked as a gap and left out, which keeps
+	// the target, and the latency players derive from it, stable at the cost of skipping the outlier.
+	TargetPercentile
+)
+
+// segments needed before the 95th percentile excludes any
+const outlierSamples = 20
+
+// values for Publisher.PlaylistType
+const (
+	PlaylistEvent = "EVENT"
+	PlaylistVOD   = "VOD"
+)
+
 type fragmenter interface {
 	av.PacketWriter
 	SetWriter(io.Writer) error
@@ -51,31 +363,193 @@ type fragmenter interface {
 
 // lock-free snapshot of HLS state for readers
 type hlsState struct {
-	playlist []byte
-	segments []*segment
+	playlist  []byte
+	gzipped   []byte
+	etag      string
+	segments  []*segment
+	listed    int
+	init      *initSegment
+	info      streamInfo
+	targetDur time.Duration
+	maxAge    time.Duration
+	seq       int64
+	dcnseq    int64
+	ended     bool
+	// closed when this state is superseded
+	changed chan struct{}
+	// sequence number of the last complete segment, and number of parts of the one following it
+	msn, partMSN int64
+	parts        int
+	// measured over the completed segments in bits per second
+	avgBitrate, peakBitrate int
+	// I-frame playlist, if enabled
+	iframes         []byte
+	iframeBandwidth int
 }
 
-// WriteHeader initializes the streams' codec data and must be called before the first WritePacket
+// check if the playlist contains the given segment, or part of the segment if part >= 0
+func (s hlsState) hasPart(msn int64, part int) bool {
+	if s.msn >= msn {
+		return true
+	}
+	return part >= 0 && s.partMSN == msn && s.parts > part
+}
+
+// stream properties advertised in a multivariant playlist
+type streamInfo struct {
+	width, height int
+	codecs        string
+	frameRate     float64
+	videoCodec    string
+}
+
+// WriteHeader initializes the streams' codec data and must be called before the first WritePacket.
+// Calling it again mid-stream is equivalent to DiscontinuityWithStreams.
 func (p *Publisher) WriteHeader(streams []av.CodecData) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLoop()
+	if p.frag != nil {
+		// codecs changed mid-stream
+		return p.changeStreams(streams)
+	}
+	return p.writeHeader(streams)
+}
+
+func (p *Publisher) writeHeader(streams []av.CodecData) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := p.start(); err != nil {
+		return err
+	}
+	p.info = streamInfo{codecs: codecsString(streams)}
+	p.lastTimes = make([]time.Duration, len(streams))
+	p.resetTimes()
+	// audio-only streams are segmented by time instead of keyframes
+	p.vidx, p.aidx = -1, -1
+	p.h264 = false
 	for i, cd := range streams {
+		if cd.Type().IsAudio() && p.aidx < 0 {
+			p.aidx = i
+		}
 		if cd.Type().IsVideo() {
 			p.vidx = i
+			p.h264 = cd.Type() == av.H264
+			p.info.videoCodec = codecString(cd)
+			if vc, ok := cd.(av.VideoCodecData); ok {
+				p.info.width, p.info.height = vc.Width(), vc.Height()
+			}
 		}
 	}
+	if p.Recorder != nil {
+		p.Recorder.tap(func() error { return p.Recorder.WriteHeader(streams) })
+	}
 	var err error
-	if p.FMP4 {
-		p.frag, err = fmp4.NewFragmenter(streams)
+	if p.Encryption != nil {
+		if p.block, err = p.Encryption.block(); err != nil {
+			return err
+		}
+	}
+	if p.fmp4() {
+		var f *fmp4.Fragmenter
+		if f, err = fmp4.NewFragmenter(streams); err != nil {
+			return err
+		}
+		if p.PartDuration > 0 {
+			// one CMAF chunk per part
+			f.FragmentLength = p.PartDuration
+		}
+		p.frag = f
+		p.initSeg = newInitSegment(f.FileHeader())
+	} else if p.Container == ContainerPackedAudio {
+		p.frag, err = adtsfrag.New(streams)
 	} else {
-		p.frag, err = tsfrag.New(streams)
+		var f *tsfrag.Fragmenter
+		if f, err = tsfrag.New(streams); err != nil {
+			return err
+		}
+		f.PSIInterval = p.PSIInterval
+		p.frag = f
 	}
 	return err
 }
 
-// WriteTrailer does nothing, but fulfills av.Muxer
-func (p *Publisher) WriteTrailer() error {
+// set up what is shared by every stream the first time segments are produced
+func (p *Publisher) start() error {
+	if p.started {
+		return nil
+	}
+	if err := p.checkWorkDir(); err != nil {
+		return err
+	}
+	if p.WriteQueue > 0 && p.queue == nil {
+		p.queue = newWriteQueue(p.WriteQueue, p.DropOnFullQueue, &p.stats)
+	}
+	p.seq = p.InitialSequence
+	p.dcnseq = p.InitialDiscontinuitySequence
+	p.started = true
 	return nil
 }
 
+// fail early if segments can't be created in WorkDir, rather than at the first keyframe
+func (p *Publisher) checkWorkDir() error {
+	d, ok := p.store().(DiskStore)
+	if !ok || d.Dir == "" {
+		return nil
+	}
+	err := d.probe()
+	if err == nil {
+		return nil
+	}
+	if p.WorkDirFallback {
+		p.noWorkDir = true
+		return nil
+	}
+	return fmt.Errorf("WorkDir %s is not writable: %v", d.Dir, err)
+}
+
+func (p *Publisher) fmp4() bool {
+	return p.FMP4 || p.Container == ContainerFMP4
+}
+
+// file extension of segments in the selected container
+func (p *Publisher) segmentExt() string {
+	switch {
+	case p.fmp4():
+		return ".m4s"
+	case p.Container == ContainerPackedAudio:
+		return ".aac"
+	}
+	return ".ts"
+}
+
+// WriteTrailer completes the current segment with the time of the last packet and finalizes any recording.
+// EVENT and VOD playlists are marked as ended, while a live playlist keeps its complete segments until they expire,
+// or starts replaying them if Loop is set.
+func (p *Publisher) WriteTrailer() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Recorder != nil {
+		p.Recorder.tap(p.Recorder.WriteTrailer)
+	}
+	err := p.endCurrent()
+	// no more segments are coming
+	for _, seg := range p.presegs {
+		seg.Release()
+	}
+	p.presegs = nil
+	if p.Loop {
+		p.startLoop()
+	} else if p.PlaylistType != "" {
+		p.ended = true
+	}
+	if len(p.segments) != 0 {
+		p.publish()
+	}
+	return err
+}
+
 // ExtendedPacket holds a packet with additional metadata for the HLS playlist
 type ExtendedPacket struct {
 	av.Packet
@@ -90,106 +564,759 @@ func (p *Publisher) WritePacket(pkt av.Packet) error {
 
 // WriteExtendedPacket publishes a packetw ith additional metadata
 func (p *Publisher) WriteExtendedPacket(pkt ExtendedPacket) error {
-	if pkt.IsKeyFrame && int(pkt.Idx) == p.vidx {
-		if err := p.newSegment(pkt.Time, pkt.ProgramTime); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ended {
+		return ErrEnded
+	}
+	p.stopLoop()
+	if p.Recorder != nil {
+		p.Recorder.tap(func() error { return p.Recorder.WritePacket(pkt.Packet) })
+	}
+	if err := p.checkTime(&pkt.Packet); err != nil {
+		return err
+	}
+	if p.RebaseTimestamps {
+		p.rebase(&pkt.Packet)
+	}
+	p.measureDrift()
+	if pkt.IsKeyFrame && int(pkt.Idx) == p.vidx && p.h264 && !p.checkKeyframe(pkt.Data) {
+		// not independently decodable, so treat it like any other frame
+		pkt.IsKeyFrame = false
+	}
+	isKey := pkt.IsKeyFrame && int(pkt.Idx) == p.vidx
+	if p.vidx < 0 {
+		// audio-only, so any packet can start a segment. Cut before the packet that would take the segment past the
+		// goal, so that segments never exceed the target duration and in turn raise it.
+		isKey = p.current == nil || pkt.Time-p.current.start+p.step > p.segmentGoal()
+	}
+	if isKey {
+		atomic.StoreInt64(&p.stats.lastKey, p.now().UnixNano())
+		if p.vidx >= 0 {
+			p.measureGOP(pkt.Time)
+		}
+	}
+	if p.current == nil && !p.waiting {
+		p.waiting = true
+		p.waitStart = pkt.Time
+	}
+	cut := isKey && (p.current == nil || p.vidx < 0 || p.longEnough(pkt.Time))
+	split := !cut && p.splitGOP(pkt.Time)
+	if split {
+		// the next segment doesn't start with a keyframe
+		p.dcn = true
+	}
+	if cut || split || p.forceCut(pkt.Time) {
+		// audio-only and forced cuts aren't known to be independent
+		independent := pkt.IsKeyFrame && int(pkt.Idx) == p.vidx
+		if err := p.newSegment(pkt.Time, independent, pkt.ProgramTime); err != nil {
+			p.logf("hls: starting segment failed: %v", err)
+			return err
+		}
+	} else if p.current != nil && p.PartDuration > 0 && (p.vidx < 0 || int(pkt.Idx) == p.vidx) && p.partFull(pkt.Time) {
+		if err := p.newPart(pkt.Time, pkt.IsKeyFrame || p.vidx < 0); err != nil {
+			p.logf("hls: starting part failed: %v", err)
 			return err
 		}
 	}
 	if p.current == nil {
 		// waiting for first keyframe
+		atomic.AddInt64(&p.stats.dropped, 1)
+		if p.KeyframeTimeout > 0 && !p.keyWarned && pkt.Time-p.waitStart >= p.KeyframeTimeout {
+			p.keyWarned = true
+			return ErrNoKeyframe
+		}
 		return nil
 	}
-	return p.frag.WritePacket(pkt.Packet)
+	p.lastTime = pkt.Time
+	if int(pkt.Idx) == p.vidx {
+		p.current.frames++
+	}
+	offset := p.current.written
+	if err := p.frag.WritePacket(pkt.Packet); err != nil {
+		p.logf("hls: writing to segment %s failed, marking it as a gap: %v", p.current.name, err)
+		p.abandon(pkt.Time)
+		return err
+	}
+	if pkt.IsKeyFrame && int(pkt.Idx) == p.vidx && p.iframesEnabled() {
+		p.current.addIFrame(pkt.Time, offset)
+	}
+	return nil
+}
+
+// give up on the current segment after writing or completing it failed. It stays in the playlist so that
+// sequence numbers aren't reused, but is marked as a gap so players don't fetch its corrupt contents, and the
+// stream restarts with a discontinuity at the next keyframe.
+func (p *Publisher) abandon(end time.Duration) {
+	seg := p.current
+	// discard anything the fragmenter still holds for the broken segment
+	if err := p.frag.SetWriter(ioutil.Discard); err == nil {
+		p.frag.Flush(end)
+	}
+	p.enc = nil
+	p.drain()
+	seg.Finalize(end)
+	seg.gap = true
+	p.current = nil
+	p.waiting = false
+	p.dcn = true
+	// the abandoned segment may have run long
+	p.targetDur = p.targetDuration()
+	p.publish()
+}
+
+// DiscontinuityWithStreams ends the current segment and replaces the codec data of the stream, e.g. after a change in
+// resolution. The next segment starts at the following keyframe and is preceded by a discontinuity marker.
+func (p *Publisher) DiscontinuityWithStreams(streams []av.CodecData) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.frag == nil {
+		return errors.New("WriteHeader has not been called")
+	}
+	return p.changeStreams(streams)
+}
+
+// end the current segment and start over with new codec data
+func (p *Publisher) changeStreams(streams []av.CodecData) error {
+	if err := p.endCurrent(); err != nil {
+		return err
+	}
+	// precreated segments may not suit the new streams
+	for _, seg := range p.presegs {
+		seg.Release()
+	}
+	p.presegs = nil
+	if err := p.writeHeader(streams); err != nil {
+		return err
+	}
+	p.logf("hls: streams changed, marking a discontinuity")
+	p.dcn = true
+	return nil
+}
+
+// Flush completes and publishes the current segment, e.g. before a graceful restart, so that the last few seconds
+// aren't lost. Unlike Close the publisher remains usable, and the next segment starts at the following keyframe.
+// It does nothing if no segment is in progress.
+func (p *Publisher) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endCurrent()
+}
+
+// complete the current segment without starting another
+func (p *Publisher) endCurrent() error {
+	if p.current == nil {
+		return nil
+	}
+	if err := p.finishSegment(p.lastTime); err != nil {
+		p.abandon(p.lastTime)
+		return err
+	}
+	p.current = nil
+	p.waiting = false
+	// the last segment isn't cut at a keyframe, so it may be longer than the rest
+	p.targetDur = p.targetDuration()
+	p.publish()
+	return nil
+}
+
+// CueOut marks the start of an ad break of the given duration, beginning with the next segment
+func (p *Publisher) CueOut(duration time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cueOut = duration
+	p.cueIn = false
+}
+
+// CueIn marks the end of an ad break, returning to the main content at the next segment
+func (p *Publisher) CueIn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cueOut = 0
+	p.cueIn = true
+}
+
+// add ad break markers to the segment that just started
+func (p *Publisher) markCue(seg *segment) {
+	switch {
+	case p.cueOut > 0:
+		seg.cue = "#EXT-X-CUE-OUT:DURATION=" + formatSeconds(p.cueOut) + "\n"
+		p.breakStart, p.breakDur = seg.start, p.cueOut
+		p.inBreak = true
+		p.cueOut = 0
+	case p.cueIn:
+		if p.inBreak {
+			seg.cue = "#EXT-X-CUE-IN\n"
+		}
+		p.inBreak = false
+		p.cueIn = false
+	case p.inBreak:
+		seg.cue = fmt.Sprintf("#EXT-X-CUE-OUT-CONT:ElapsedTime=%s,Duration=%s\n", formatSeconds(seg.start-p.breakStart), formatSeconds(p.breakDur))
+	}
+}
+
+// check if the current part must end before a packet at t, since including it would take the part past
+// PART-TARGET, which LL-HLS forbids
+func (p *Publisher) partFull(t time.Duration) bool {
+	elapsed := t - p.current.partStart
+	return elapsed > 0 && elapsed+p.step > p.PartDuration
+}
+
+// track the interval between keyframes
+func (p *Publisher) measureGOP(t time.Duration) {
+	if d := t - p.prevKey; p.prevKey != noTime && d > 0 {
+		p.gop = d
+	}
+	p.prevKey = t
+}
+
+// check if the current segment can end at a keyframe arriving at t
+func (p *Publisher) longEnough(t time.Duration) bool {
+	elapsed := t - p.current.start
+	if elapsed < p.MinSegmentDuration {
+		return false
+	}
+	if p.TargetSegmentDuration <= 0 {
+		return true
+	}
+	// keep going if the next keyframe is expected to end the segment closer to the target
+	return elapsed+p.gop/2 >= p.TargetSegmentDuration
+}
+
+// check if the current segment has reached TargetSegmentDuration and must be cut without waiting for a keyframe
+func (p *Publisher) splitGOP(t time.Duration) bool {
+	if !p.SplitLongGOPs || p.TargetSegmentDuration <= 0 || p.current == nil || p.vidx < 0 {
+		return false
+	}
+	return t-p.current.start >= p.TargetSegmentDuration
+}
+
+// check if a segment must be cut without waiting for a keyframe
+func (p *Publisher) forceCut(t time.Duration) bool {
+	if p.MaxSegmentDuration <= 0 {
+		return false
+	}
+	if p.current == nil {
+		return t-p.waitStart >= p.MaxSegmentDuration
+	}
+	return t-p.current.start >= p.MaxSegmentDuration
 }
 
 // Discontinuity inserts a marker into the playlist before the next segment indicating that the decoder should be reset
 func (p *Publisher) Discontinuity() {
+	p.mu.Lock()
 	p.dcn = true
+	p.resetTimes()
+	// the source's clock may restart too, so carry on from the last packet rather than from the old offset
+	p.retime = true
+	p.logf("hls: discontinuity requested")
+	p.mu.Unlock()
+}
+
+// timestamps further than this behind the previous packet in the same stream indicate the source clock was reset
+const backwardJump = time.Second
+
+// keep each stream's timestamps monotonic, starting a discontinuity if the source clock jumps backwards
+func (p *Publisher) checkTime(pkt *av.Packet) error {
+	i := int(pkt.Idx)
+	if i < 0 || i >= len(p.lastTimes) {
+		return nil
+	}
+	last := p.lastTimes[i]
+	if last != noTime && pkt.Time < last-backwardJump {
+		// restart at the next keyframe
+		p.logf("hls: stream %d jumped back from %s to %s, restarting with a discontinuity", i, last, pkt.Time)
+		if err := p.endCurrent(); err != nil {
+			p.logf("hls: completing segment failed: %v", err)
+			return err
+		}
+		p.dcn = true
+		p.resetTimes()
+		last = noTime
+		atomic.AddInt64(&p.stats.autoDcn, 1)
+	} else if pkt.Time < last {
+		pkt.Time = last
+		atomic.AddInt64(&p.stats.corrected, 1)
+	} else if p.MaxGap > 0 && p.current != nil && !p.dcn && p.isGap(pkt.Time, last) {
+		// the source stalled, so mark the next segment
+		p.logf("hls: stream %d stalled at %s, marking a discontinuity", i, last)
+		p.dcn = true
+		atomic.AddInt64(&p.stats.autoDcn, 1)
+	}
+	p.step = 0
+	if last != noTime {
+		p.step = pkt.Time - last
+	}
+	p.lastTimes[i] = pkt.Time
+	p.arrival = p.now()
+	return nil
+}
+
+// check if a packet follows a stall in either media time or arrival time
+func (p *Publisher) isGap(t, last time.Duration) bool {
+	if last != noTime && t-last > p.MaxGap {
+		return true
+	}
+	return !p.arrival.IsZero() && p.now().Sub(p.arrival) > p.MaxGap
+}
+
+// time the first packet is moved to by RebaseTimestamps, leaving room for streams starting slightly earlier
+const rebaseStart = time.Second
+
+// shift a packet onto the publisher's timeline, choosing the offset at the first packet after a (re)start
+func (p *Publisher) rebase(pkt *av.Packet) {
+	if (p.current == nil && !p.waiting) || p.retime {
+		base := rebaseStart
+		if p.rebased {
+			// carry on from where the previous segment ended
+			base = p.lastTime
+		}
+		p.tsOffset = pkt.Time - base
+		p.rebased = true
+		p.retime = false
+	}
+	pkt.Time -= p.tsOffset
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+}
+
+// placeholder for streams that haven't had a packet since the start or the last discontinuity
+const noTime = time.Duration(math.MinInt64)
+
+func (p *Publisher) resetTimes() {
+	for i := range p.lastTimes {
+		p.lastTimes[i] = noTime
+	}
+	p.prevKey = noTime
 }
 
 // start a new segment
-func (p *Publisher) newSegment(start time.Duration, programTime time.Time) error {
-	if p.current != nil {
+func (p *Publisher) newSegment(start time.Duration, independent bool, programTime time.Time) error {
+	prev := p.current
+	if n := int64(p.DebugDiscontinuityEvery); n > 0 && prev != nil && (prev.seq+1)%n == 0 {
+		p.dcn = true
+	}
+	if prev != nil {
 		// complete the previous segment
-		if err := p.frag.Flush(start); err != nil {
+		if err := p.finishSegment(start); err != nil {
+			p.abandon(start)
 			return err
 		}
-		p.current.Finalize(start)
 	}
-	var ptFormatted string
-	if !programTime.IsZero() {
-		ptFormatted = programTime.UTC().Format("2006-01-02T15:04:05.999Z07:00")
+	if programTime.IsZero() {
+		programTime = p.programTime(prev)
 	}
 	initialDur := p.targetDuration()
-	if p.segNum == 0 {
-		p.segNum = time.Now().UnixNano()
-	}
 	if len(p.presegs) != 0 {
 		// use a precreated segment
 		p.current = p.presegs[0]
 		copy(p.presegs, p.presegs[1:])
 		p.presegs = p.presegs[:len(p.presegs)-1]
 	} else {
-		var err error
-		p.current, err = newSegment(p.segNum, p.WorkDir, p.FMP4)
+		name, err := p.segmentName(p.seq + int64(len(p.segments)))
 		if err != nil {
 			return err
 		}
+		p.current = newSegment(name, p.segmentExt())
+	}
+	// storage is only allocated once the segment is used, so precreating many is cheap
+	if err := p.current.create(p.store()); err != nil {
+		p.current = nil
+		return err
+	}
+	p.current.activate(p.seq+int64(len(p.segments)), start, initialDur, p.dcn, independent, programTime)
+	p.current.queue = p.queue
+	p.current.init = p.initSeg
+	p.current.wallStart = p.now()
+	atomic.StoreInt64(&p.stats.lastSeg, p.current.wallStart.UnixNano())
+	p.markCue(p.current)
+	if p.dcn {
+		p.logf("hls: started segment %s seq=%d at %s after a discontinuity", p.current.name, p.current.seq, start)
+	} else {
+		p.logf("hls: started segment %s seq=%d at %s", p.current.name, p.current.seq, start)
 	}
-	p.current.activate(start, initialDur, p.dcn, ptFormatted)
 	p.dcn = false
-	p.segNum++
-	if err := p.frag.SetWriter(p.current); err != nil {
+	w := io.Writer(p.current)
+	if p.block != nil {
+		p.enc = newCBCWriter(p.current, p.block, p.Encryption.segmentIV(p.current.seq))
+		w = p.enc
+	}
+	if err := p.frag.SetWriter(w); err != nil {
+		// not listed yet, so it can just be dropped
+		p.current.Release()
+		p.current = nil
+		p.enc = nil
 		return err
 	}
+	p.current.hdrLen = p.current.written
 	// add the new segment and remove the old
 	p.segments = append(p.segments, p.current)
 	p.trimSegments(initialDur)
-	// build playlist
-	var b bytes.Buffer
-	ver := 3
-	if p.FMP4 {
-		ver = 6
+	p.targetDur = initialDur
+	// precreate next segment, before publishing so that the playlist lists all of them
+	for len(p.presegs) < p.Precreate {
+		// sequence number is known in advance since precreated segments are used in order
+		seq := p.current.seq + 1 + int64(len(p.presegs))
+		name, err := p.segmentName(seq)
+		if err != nil {
+			return err
+		}
+		s := newSegment(name, p.segmentExt())
+		s.seq = seq
+		p.presegs = append(p.presegs, s)
 	}
-	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", ver, int(initialDur.Seconds()))
-	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.seq)
-	if p.dcnseq != 0 {
-		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.dcnseq)
+	p.publish()
+	p.notify(prev, p.current)
+	return nil
+}
+
+// program date-time for the segment following prev, if ProgramDateTime is set
+func (p *Publisher) programTime(prev *segment) time.Time {
+	if !p.ProgramDateTime {
+		return time.Time{}
 	}
-	if p.FMP4 {
-		b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	if prev == nil || prev.ptime.IsZero() || p.dcn {
+		// anchor to the real clock at the start and after a discontinuity
+		return p.now()
 	}
-	segments := make([]*segment, len(p.segments)+len(p.presegs))
-	copy(segments, p.segments)
-	copy(segments[len(p.segments):], p.presegs)
-	for _, chunk := range segments {
-		b.WriteString(chunk.Format(p.Prefetch))
+	// advance by media time to avoid drift
+	return prev.ptime.Add(prev.dur)
+}
+
+// choose the file name, without extension, of the segment with the given media sequence number
+func (p *Publisher) segmentName(seq int64) (string, error) {
+	if !p.seeded {
+		p.segNum = p.now().UnixNano()
+		if p.DeterministicNames {
+			p.segNum = p.SegmentSeed
+		}
+		p.seeded = true
 	}
-	// publish a snapshot of the segment list
-	p.state.Store(hlsState{b.Bytes(), segments})
-	// precreate next segment
-	for len(p.presegs) < p.Precreate {
-		s, err := newSegment(p.segNum, p.WorkDir, p.FMP4)
+	if p.SegmentNameFunc == nil {
+		name := strconv.FormatInt(p.segNum, 36)
+		p.segNum++
+		return name, nil
+	}
+	name := p.SegmentNameFunc(seq)
+	if name == "" || !p.validName(name+p.segmentExt()) {
+		// it would be written outside the store's directory, or never match a request
+		return "", fmt.Errorf("segment name %q is not a plain file name", name)
+	}
+	for _, segs := range [][]*segment{p.segments, p.presegs} {
+		for _, seg := range segs {
+			if strings.TrimSuffix(seg.name, path.Ext(seg.name)) == name {
+				return "", fmt.Errorf("segment name %q is already in use", name)
+			}
+		}
+	}
+	return name, nil
+}
+
+// complete the current segment, given the time of the packet following it
+func (p *Publisher) finishSegment(end time.Duration) error {
+	if err := p.frag.Flush(end); err != nil {
+		return err
+	}
+	if p.PartDuration > 0 {
+		if err := p.drain(); err != nil {
+			return err
+		}
+		p.current.endPart(end, true)
+	}
+	if p.enc != nil {
+		if err := p.enc.Close(); err != nil {
+			return err
+		}
+		p.enc = nil
+	}
+	if err := p.drain(); err != nil {
+		return err
+	}
+	return p.completeSegment(p.current, p.blendedEnd(end))
+}
+
+// finalize a segment once all of its contents are written, and report it
+func (p *Publisher) completeSegment(seg *segment, end time.Duration) error {
+	if err := seg.Finalize(end); err != nil {
+		return err
+	}
+	size := seg.stored()
+	if size <= seg.hdrLen || size < p.MinValidSegmentBytes || seg.dropped {
+		// nothing playable was written, so tell players to skip it
+		seg.gap = true
+	} else if p.outlier(seg) {
+		// listing it would raise the target duration
+		seg.gap = true
+	} else if p.SegmentBitrate && seg.dur > 0 {
+		seg.kbps = int(math.Round(float64(size*8) / seg.dur.Seconds() / 1000))
+	}
+	p.stats.segmentDone(seg, p.targetDur)
+	if p.OnSegmentComplete != nil {
+		p.OnSegmentComplete(seg.info())
+	}
+	if p.Sink != nil {
+		info := seg.info()
+		r, err := info.Open()
 		if err != nil {
 			return err
 		}
-		p.presegs = append(p.presegs, s)
-		p.segNum++
+		return p.Sink(info, r)
 	}
 	return nil
 }
 
-// calculate the longest segment duration
-func (p *Publisher) targetDuration() time.Duration {
-	var maxTime time.Duration
-	for _, chunk := range p.segments {
-		if chunk.dur > maxTime {
-			maxTime = chunk.dur
+// apply WallClockWeight to the end time of the current segment
+func (p *Publisher) blendedEnd(end time.Duration) time.Duration {
+	w := p.WallClockWeight
+	if w <= 0 {
+		return end
+	} else if w > 1 {
+		w = 1
+	}
+	media := float64(end - p.current.start)
+	wall := float64(p.now().Sub(p.current.wallStart))
+	return p.current.start + time.Duration((1-w)*media+w*wall)
+}
+
+// complete the current partial segment and publish it
+func (p *Publisher) newPart(next time.Duration, independent bool) error {
+	if err := p.frag.Flush(next); err != nil {
+		p.abandon(next)
+		return err
+	}
+	if err := p.drain(); err != nil {
+		p.abandon(next)
+		return err
+	}
+	p.current.endPart(next, independent)
+	p.publish()
+	return nil
+}
+
+// build the playlist and publish a snapshot of the segment list
+func (p *Publisher) publish() {
+	// build in a reused buffer, then copy it out since readers keep the snapshot
+	b := &p.plbuf
+	b.Reset()
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", p.version(), int(p.targetDur.Seconds()))
+	if p.PlaylistType != "" {
+		fmt.Fprintf(b, "#EXT-X-PLAYLIST-TYPE:%s\n", p.PlaylistType)
+	}
+	if p.independentSegments() {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if p.StartOffset != 0 {
+		fmt.Fprintf(b, "#EXT-X-START:TIME-OFFSET=%s,PRECISE=YES\n", formatSeconds(p.StartOffset))
+	}
+	partsFrom := len(p.segments)
+	if p.PartDuration > 0 {
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s,HOLD-BACK=%s\n",
+			formatSeconds(p.partHoldBack()), formatSeconds(p.holdBack()))
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%s\n", formatSeconds(p.PartDuration))
+		// list parts for segments within 3 target durations of the live edge
+		var edgeDur time.Duration
+		for partsFrom > 0 && edgeDur < 3*p.targetDur {
+			partsFrom--
+			edgeDur += p.segments[partsFrom].dur
+		}
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.seq)
+	if p.dcnseq != 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.dcnseq)
+	}
+	segments := make([]*segment, len(p.segments)+len(p.presegs))
+	copy(segments, p.segments)
+	copy(segments[len(p.segments):], p.presegs)
+	var init *initSegment
+	for i, chunk := range segments {
+		cur := chunk.init
+		if cur == nil {
+			// precreated segments don't know their init segment until they are used
+			cur = p.initSeg
+		}
+		b.WriteString(mapTag(init, cur))
+		init = cur
+		if p.block != nil {
+			b.WriteString(p.Encryption.keyTag(chunk.seq))
+		}
+		b.WriteString(chunk.Format(p.Prefetch, i >= partsFrom && i < len(p.segments), p.PartByteRanges))
+	}
+	if p.PartDuration > 0 && !p.PartByteRanges && p.current != nil && !p.current.final {
+		// clients can request the next part before it is complete
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", p.current.partName(len(p.current.parts)))
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	if p.PartDuration > 0 {
+		p.renditionReports(b)
+	}
+	var playlistDur time.Duration
+	for _, seg := range p.segments {
+		playlistDur += seg.dur
+	}
+	atomic.StoreInt64(&p.stats.playlistDur, int64(playlistDur))
+	atomic.StoreInt64(&p.stats.active, int64(len(segments)))
+	info := p.info
+	info.frameRate = p.frameRate()
+	state := hlsState{
+		playlist:  append([]byte(nil), b.Bytes()...),
+		segments:  segments,
+		gzipped:   p.compress(b.Bytes()),
+		etag:      playlistETag(b.Bytes()),
+		listed:    len(p.segments),
+		init:      p.initSeg,
+		info:      info,
+		targetDur: p.targetDur,
+		maxAge:    p.segmentMaxAge(),
+		seq:       p.seq,
+		dcnseq:    p.dcnseq,
+		ended:     p.ended,
+		changed:   make(chan struct{}),
+		msn:       p.seq + int64(len(p.segments)) - 1,
+	}
+	if p.iframesEnabled() {
+		state.iframes, state.iframeBandwidth = p.iframePlaylist()
+	}
+	state.avgBitrate, state.peakBitrate = p.bitrate()
+	state.partMSN = state.msn
+	if p.PartDuration > 0 && p.current != nil && !p.current.final {
+		// the live segment is only listed as parts
+		state.msn--
+		state.parts = len(p.current.parts)
+	}
+	p.state.Store(state)
+	// wake blocked playlist requests
+	if p.changed != nil {
+		close(p.changed)
+	}
+	p.changed = state.changed
+}
+
+// check if every segment in the playlist starts with a keyframe
+func (p *Publisher) independentSegments() bool {
+	if p.IndependentSegments {
+		return true
+	}
+	for _, seg := range p.segments {
+		if !seg.indep {
+			return false
+		}
+	}
+	return len(p.segments) != 0
+}
+
+func (p *Publisher) partHoldBack() time.Duration {
+	if p.PartHoldBack == 0 {
+		return 3 * p.PartDuration
+	}
+	return p.PartHoldBack
+}
+
+// HoldBack, raised to the minimum for the current target duration
+func (p *Publisher) holdBack() time.Duration {
+	if min := 3 * p.targetDur; p.HoldBack < min {
+		return min
+	}
+	return p.HoldBack
+}
+
+// gzip the playlist once so every request can share it
+func (p *Publisher) compress(playlist []byte) []byte {
+	var b bytes.Buffer
+	if p.gz == nil {
+		p.gz = gzip.NewWriter(&b)
+	} else {
+		p.gz.Reset(&b)
+	}
+	if _, err := p.gz.Write(playlist); err != nil {
+		return nil
+	}
+	if err := p.gz.Close(); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// weak entity tag identifying the playlist content, regardless of encoding
+func playlistETag(playlist []byte) string {
+	h := fnv.New64a()
+	h.Write(playlist)
+	return fmt.Sprintf("W/\"%x\"", h.Sum64())
+}
+
+// check if an If-None-Match header matches the current entity tag
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the client accepts gzip content encoding
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0") {
+			return true
+		}
+	}
+	return false
+}
+
+// lowest protocol version supporting the tags used in the media playlist
+func (p *Publisher) version() int {
+	if p.Version != 0 {
+		return p.Version
+	}
+	// fractional EXTINF
+	ver := 3
+	if p.fmp4() || p.PartDuration > 0 {
+		// EXT-X-MAP without I-FRAMES-ONLY
+		ver = 6
+	}
+	if p.SegmentBitrate {
+		// EXT-X-BITRATE
+		ver = 8
+	}
+	for _, seg := range p.segments {
+		if seg.gap {
+			ver = 8
+			break
 		}
 	}
-	maxTime = maxTime.Round(time.Second)
+	return ver
+}
+
+// measure the video frame rate over the completed segments
+func (p *Publisher) frameRate() float64 {
+	var frames int
+	var dur time.Duration
+	for _, seg := range p.segments {
+		if seg != p.current {
+			frames += seg.frames
+			dur += seg.dur
+		}
+	}
+	if frames == 0 || dur <= 0 {
+		return 0
+	}
+	return float64(frames) / dur.Seconds()
+}
+
+// calculate the longest segment duration
+func (p *Publisher) targetDuration() time.Duration {
+	maxTime, _ := p.segmentDuration(nil)
+	maxTime = ceilSeconds(maxTime)
 	if maxTime == 0 {
-		maxTime = p.InitialDuration
+		maxTime = ceilSeconds(p.InitialDuration)
+		if maxTime < p.MinSegmentDuration {
+			maxTime = ceilSeconds(p.MinSegmentDuration)
+		}
 	}
 	if maxTime == 0 {
 		maxTime = 5 * time.Second
@@ -197,21 +1324,181 @@ func (p *Publisher) targetDuration() time.Duration {
 	return maxTime
 }
 
+// length audio-only segments are cut at. Unlike the advertised target duration it is fixed, since that is derived
+// from the segments themselves.
+func (p *Publisher) segmentGoal() time.Duration {
+	if p.TargetSegmentDuration > 0 {
+		return p.TargetSegmentDuration
+	}
+	goal := p.InitialDuration
+	if goal < p.MinSegmentDuration {
+		goal = p.MinSegmentDuration
+	}
+	if goal <= 0 {
+		goal = 5 * time.Second
+	}
+	return goal
+}
+
+// duration of the longest listed segment other than exclude, or the percentile chosen by TargetDurationStrategy,
+// along with the number of segments considered
+func (p *Publisher) segmentDuration(exclude *segment) (time.Duration, int) {
+	percentile := p.TargetDurationStrategy == TargetPercentile
+	var durs []time.Duration
+	for _, chunk := range p.segments {
+		if chunk == exclude || (percentile && chunk.gap) {
+			continue
+		}
+		durs = append(durs, chunk.dur)
+	}
+	if len(durs) == 0 {
+		return 0, 0
+	}
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	i := len(durs) - 1
+	if percentile && len(durs) >= outlierSamples {
+		i = (len(durs)*95+99)/100 - 1
+	}
+	return durs[i], len(durs)
+}
+
+// check if a completed segment is too long to be listed under TargetPercentile
+func (p *Publisher) outlier(seg *segment) bool {
+	if p.TargetDurationStrategy != TargetPercentile {
+		return false
+	}
+	d, n := p.segmentDuration(seg)
+	return n >= outlierSamples && ceilSeconds(seg.dur) > ceilSeconds(d)
+}
+
+// round a duration up to whole seconds, so that a target duration is never less than the EXTINF it covers.
+// EXTINF is written with millisecond precision, so that is the precision compared.
+func ceilSeconds(d time.Duration) time.Duration {
+	d = d.Round(time.Millisecond)
+	return (d + time.Second - 1) / time.Second * time.Second
+}
+
+func (p *Publisher) store() SegmentStore {
+	switch {
+	case p.Sink != nil:
+		return MemoryStore{}
+	case p.Store != nil:
+		return p.Store
+	case p.InMemory:
+		return MemoryStore{}
+	case p.noWorkDir:
+		return DiskStore{Prefix: p.WorkDirPrefix}
+	default:
+		return DiskStore{Dir: p.WorkDir, Prefix: p.WorkDirPrefix}
+	}
+}
+
+func (p *Publisher) bufferLength() time.Duration {
+	if p.BufferLength == 0 {
+		return 60 * time.Second
+	}
+	return p.BufferLength
+}
+
+// SetBufferLength changes BufferLength while the stream is running.
+// A shorter length takes effect immediately, while a longer one stops old segments being removed until it is reached.
+func (p *Publisher) SetBufferLength(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.BufferLength = d
+	if p.current != nil {
+		p.trimSegments(p.targetDur)
+		p.publish()
+	}
+}
+
+// CleanupWorkDir removes segment files left in WorkDir by an earlier process with the same WorkDirPrefix, e.g. after a crash.
+// Call it before WriteHeader. It does nothing if segments aren't stored in WorkDir.
+func (p *Publisher) CleanupWorkDir() error {
+	if d, ok := p.store().(DiskStore); ok {
+		return d.Cleanup()
+	}
+	return nil
+}
+
+// SetPrecreate changes Precreate while the stream is running.
+// Extra precreated segments are released immediately, while more are created when the next segment starts.
+// Like Precreate it requires Prefetch, and without it n is treated as 0.
+func (p *Publisher) SetPrecreate(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n < 0 || !p.Prefetch {
+		n = 0
+	}
+	p.Precreate = n
+	if len(p.presegs) <= n {
+		return
+	}
+	for _, seg := range p.presegs[n:] {
+		seg.Release()
+	}
+	p.presegs = p.presegs[:n]
+	if p.current != nil {
+		p.publish()
+	}
+}
+
+func (p *Publisher) segmentMaxAge() time.Duration {
+	if p.SegmentMaxAge == 0 {
+		return p.bufferLength()
+	}
+	return p.SegmentMaxAge
+}
+
 // remove the oldest segment until the total length is less than configured
 func (p *Publisher) trimSegments(segmentLen time.Duration) {
-	goalLen := p.BufferLength
-	if goalLen == 0 {
-		goalLen = 60 * time.Second
+	if p.Sink != nil {
+		// completed segments have already been handed off
+		p.releaseSegments(len(p.segments) - 1)
+		return
 	}
+	if p.PlaylistType != "" {
+		// EVENT and VOD playlists only ever grow
+		return
+	}
+	goalLen := p.bufferLength()
 	keepSegments := int((goalLen+segmentLen-1)/segmentLen + 1)
-	if keepSegments < 10 {
-		keepSegments = 10
+	minSegments := p.MinSegments
+	if minSegments <= 0 {
+		minSegments = 10
+	}
+	if keepSegments < minSegments {
+		keepSegments = minSegments
+	}
+	if p.MaxSegments > 0 && keepSegments > p.MaxSegments {
+		keepSegments = p.MaxSegments
 	}
 	n := len(p.segments) - keepSegments
+	if n < 0 {
+		n = 0
+	}
+	if p.MaxDiskBytes > 0 {
+		var size int64
+		for _, seg := range p.segments[n:] {
+			size += seg.stored()
+		}
+		// always keep the live segment
+		for size > p.MaxDiskBytes && n < len(p.segments)-1 {
+			size -= p.segments[n].stored()
+			n++
+			atomic.AddInt64(&p.stats.evicted, 1)
+		}
+	}
+	p.releaseSegments(n)
+}
+
+// remove the n oldest segments from the playlist
+func (p *Publisher) releaseSegments(n int) {
 	if n <= 0 {
 		return
 	}
 	for _, seg := range p.segments[:n] {
+		p.logf("hls: removed segment %s seq=%d", seg.name, seg.seq)
 		p.seq++
 		if seg.dcn {
 			p.dcnseq++
@@ -221,38 +1508,421 @@ func (p *Publisher) trimSegments(segmentLen time.Duration) {
 	p.segments = p.segments[n:]
 }
 
-// serve the HLS playlist and segments
+// serve the HLS playlist and segments.
+//
+// Only names that appear in the current playlist state are ever served, and segments are read only from the
+// publisher's own storage, so no request can cause an arbitrary filesystem path to be opened.
 func (p *Publisher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.serve(rw, req, func(rw http.ResponseWriter, req *http.Request, state hlsState, bn string) {
+		if bn == p.PlaylistName() || bn == p.MasterFile || bn == "iframes.m3u8" {
+			p.servePlaylist(rw, req, state, bn)
+		} else {
+			p.serveSegment(rw, req, state, bn)
+		}
+	})
+}
+
+// ServePlaylist serves only the media playlist, I-frame playlist and MasterFile, so that access checks can be applied
+// to them separately from segments. Other names get 404.
+func (p *Publisher) ServePlaylist(rw http.ResponseWriter, req *http.Request) {
+	p.serve(rw, req, p.servePlaylist)
+}
+
+// ServeSegment serves only the segments, partial segments, init segment and key referenced by the playlist.
+// Other names, including the playlist itself, get 404.
+func (p *Publisher) ServeSegment(rw http.ResponseWriter, req *http.Request) {
+	p.serve(rw, req, p.serveSegment)
+}
+
+// handle what is common to all requests, then pass the current state and file name to f
+func (p *Publisher) serve(rw http.ResponseWriter, req *http.Request, f func(http.ResponseWriter, *http.Request, hlsState, string)) {
+	if !p.beginRequest() {
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.inflight.Done()
+	if p.Sink != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	if p.setCORS(rw, req) && req.Method == http.MethodOptions {
+		// preflight
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
 	state, ok := p.state.Load().(hlsState)
 	if !ok {
-		http.NotFound(rw, req)
+		if p.NotFoundBeforeStart {
+			http.NotFound(rw, req)
+			return
+		}
+		// the first segment hasn't started yet, so ask the player to try again shortly
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "stream not started", http.StatusServiceUnavailable)
 		return
 	}
 	bn := path.Base(req.URL.Path)
+	if !p.validName(bn) {
+		http.NotFound(rw, req)
+		return
+	}
+	f(rw, req, state, bn)
+}
+
+func (p *Publisher) servePlaylist(rw http.ResponseWriter, req *http.Request, state hlsState, bn string) {
 	switch bn {
-	case "index.m3u8":
-		rw.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	case p.PlaylistName():
+		if p.stale(state) {
+			http.Error(rw, "stream is stale", http.StatusServiceUnavailable)
+			return
+		}
+		if q := req.URL.Query(); q.Get("_HLS_msn") != "" || q.Get("_HLS_part") != "" {
+			// a part without a sequence number is rejected along with malformed ones
+			var code int
+			if state, code = p.blockingReload(req.Context(), state, q); code != http.StatusOK {
+				http.Error(rw, http.StatusText(code), code)
+				return
+			}
+		}
+		rw.Header().Set("Content-Type", p.playlistContentType())
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Header().Set("ETag", state.etag)
+		if etagMatch(req.Header.Get("If-None-Match"), state.etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if p.PreloadHints {
+			p.preload(rw, req, state)
+		}
+		if state.gzipped != nil && acceptsGzip(req) {
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Write(state.gzipped)
+			return
+		}
 		rw.Write(state.playlist)
 		return
-	case "init.mp4":
-		if b := p.frag.FileHeader(); len(b) != 0 {
-			rw.Header().Set("Content-Type", "video/mp4")
-			rw.Write(b)
+	case p.MasterFile:
+		m := MasterPlaylist{variants: []Variant{{Name: ".", Publisher: p}}}
+		b := m.playlist()
+		if len(b) == 0 {
+			if p.NotFoundBeforeStart {
+				break
+			}
+			// no segment has been measured yet, so ask the player to try again like the media playlist does
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "bitrate not measured yet", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Content-Type", p.playlistContentType())
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Write(b)
+		return
+	case "iframes.m3u8":
+		if state.iframes != nil {
+			rw.Header().Set("Content-Type", p.playlistContentType())
+			rw.Header().Set("Cache-Control", "no-cache")
+			rw.Write(state.iframes)
 			return
 		}
 	}
-	for _, chunk := range state.segments {
+	http.NotFound(rw, req)
+}
+
+func (p *Publisher) serveSegment(rw http.ResponseWriter, req *http.Request, state hlsState, bn string) {
+	if init := state.initSegment(bn); init != nil {
+		rw.Header().Set("Content-Type", mimeType(bn))
+		rw.Header().Set("Cache-Control", initCache)
+		rw.Write(init.data)
+		return
+	}
+	if p.Encryption != nil && p.Encryption.KeyName != "" && bn == p.Encryption.KeyName {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		// keep the key out of shared caches
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.Write(p.Encryption.Key)
+		return
+	}
+	segmentCache := fmt.Sprintf("public, max-age=%d", int(state.maxAge.Seconds()))
+	for i, chunk := range state.segments {
 		if chunk.name == bn {
+			rw.Header().Set("Cache-Control", segmentCache)
+			if p.PrimeSegments > 0 && p.atEdge(state, i) {
+				rw.Header().Set("X-Live-Edge", "1")
+			}
+			if p.SegmentHeaders && i < state.listed {
+				chunk.setHeaders(rw.Header(), -1)
+			}
 			chunk.serveHTTP(rw, req)
 			return
 		}
 	}
+	if p.PartDuration > 0 {
+		// partial segments are named like their parent, with the part index before the extension
+		ext := path.Ext(bn)
+		stem := bn[:len(bn)-len(ext)]
+		if i := strings.LastIndexByte(stem, '.'); i >= 0 {
+			parent := stem[:i] + ext
+			if idx, err := strconv.Atoi(stem[i+1:]); err == nil && idx >= 0 {
+				for j, chunk := range state.segments {
+					if chunk.name == parent {
+						rw.Header().Set("Cache-Control", segmentCache)
+						if p.SegmentHeaders && j < state.listed {
+							chunk.setHeaders(rw.Header(), idx)
+						}
+						chunk.servePart(rw, req, idx, p.PartLookahead && req.URL.Query().Get("lookahead") == "1")
+						return
+					}
+				}
+			}
+		}
+	}
 	http.NotFound(rw, req)
 }
 
-// Close frees resources associated with the publisher
+// hint and push the files a player joining at the live edge will need next
+func (p *Publisher) preload(rw http.ResponseWriter, req *http.Request, state hlsState) {
+	var names []string
+	if state.init != nil {
+		names = append(names, state.init.name)
+	}
+	for i, seg := range state.segments[:state.listed] {
+		if p.atEdge(state, i) {
+			names = append(names, seg.name)
+		}
+	}
+	pusher, _ := rw.(http.Pusher)
+	// pushes need the full path, from before any prefix was stripped
+	dir := path.Dir(req.URL.Path)
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		dir = path.Dir(u.Path)
+	}
+	for _, name := range names {
+		rw.Header().Add("Link", "<"+name+">; rel=preload; as=fetch")
+		if pusher != nil {
+			if err := pusher.Push(path.Join(dir, name), nil); err != nil {
+				// not supported by the client, or pushes disabled
+				pusher = nil
+			}
+		}
+	}
+}
+
+// check if the i'th segment of a state is one of the most recent, including precreated segments
+func (p *Publisher) atEdge(state hlsState, i int) bool {
+	n := p.PrimeSegments
+	if n <= 0 {
+		n = 3
+	}
+	return i >= state.listed-n
+}
+
+// Handler returns a handler that serves the stream beneath the given path prefix, e.g. "/stream1/",
+// so that several publishers can be mounted on one mux.
+// Only the playlist and the files it currently references are served; anything else, including paths with further
+// directory components, gets 404.
+func (p *Publisher) Handler(prefix string) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if name := req.URL.Path; name == "" || strings.ContainsRune(name, '/') || name == ".." {
+			http.NotFound(rw, req)
+			return
+		}
+		p.ServeHTTP(rw, req)
+	}))
+}
+
+// reject malformed file names before looking them up
+func (p *Publisher) validName(name string) bool {
+	if name == "" || strings.Contains(name, "..") || strings.ContainsAny(name, "\x00/\\") {
+		return false
+	}
+	if p.Encryption != nil && p.Encryption.KeyName != "" && name == p.Encryption.KeyName {
+		return true
+	}
+	switch path.Ext(name) {
+	case ".m3u8", ".ts", ".m4s", ".mp4", ".aac":
+		return true
+	}
+	return name == p.PlaylistName()
+}
+
+// check if the source has stopped sending segments for longer than StaleAfter allows
+func (p *Publisher) stale(state hlsState) bool {
+	return p.StaleAfter > 0 && p.idleFor(state, p.StaleAfter)
+}
+
+// check if no segment has started for n target durations
+func (p *Publisher) idleFor(state hlsState, n int) bool {
+	if state.ended {
+		return false
+	}
+	last := p.LastSegmentTime()
+	return !last.IsZero() && p.now().Sub(last) > time.Duration(n)*state.targetDur
+}
+
+// read the wall clock
+func (p *Publisher) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// Content-Type of playlist responses
+func (p *Publisher) playlistContentType() string {
+	if p.PlaylistContentType != "" {
+		return p.PlaylistContentType
+	}
+	return mimeType(".m3u8")
+}
+
+// PlaylistName returns the file name the media playlist is served as, which is PlaylistFile if set
+func (p *Publisher) PlaylistName() string {
+	if p.PlaylistFile != "" {
+		return p.PlaylistFile
+	}
+	return "index.m3u8"
+}
+
+// add CORS headers to the response if enabled and the origin is allowed
+func (p *Publisher) setCORS(rw http.ResponseWriter, req *http.Request) bool {
+	if !p.AllowCORS {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	h := rw.Header()
+	if len(p.AllowedOrigins) != 0 {
+		h.Add("Vary", "Origin")
+		var allowed bool
+		for _, o := range p.AllowedOrigins {
+			if o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	} else if origin == "" {
+		origin = "*"
+	} else {
+		h.Add("Vary", "Origin")
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Range")
+	h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+	return true
+}
+
+// wait until the playlist contains the segment or part requested by the client
+func (p *Publisher) blockingReload(ctx context.Context, state hlsState, q url.Values) (hlsState, int) {
+	msn, err := strconv.ParseInt(q.Get("_HLS_msn"), 10, 64)
+	if err != nil || msn < 0 {
+		return state, http.StatusBadRequest
+	}
+	part := -1
+	if v := q.Get("_HLS_part"); v != "" {
+		part, err = strconv.Atoi(v)
+		if err != nil || part < 0 {
+			return state, http.StatusBadRequest
+		}
+	}
+	if msn > state.partMSN+2 {
+		// too far in the future
+		return state, http.StatusBadRequest
+	}
+	timeout := time.NewTimer(3 * state.targetDur)
+	defer timeout.Stop()
+	shutdown := p.shutdownChan()
+	for !state.hasPart(msn, part) {
+		select {
+		case <-state.changed:
+		case <-timeout.C:
+			return state, http.StatusServiceUnavailable
+		case <-shutdown:
+			return state, http.StatusServiceUnavailable
+		case <-ctx.Done():
+			return state, http.StatusServiceUnavailable
+		}
+		next, ok := p.state.Load().(hlsState)
+		if !ok || next.playlist == nil {
+			// closed
+			return state, http.StatusNotFound
+		}
+		state = next
+	}
+	return state, http.StatusOK
+}
+
+// track an in-flight request, unless shutting down
+func (p *Publisher) beginRequest() bool {
+	p.serveMu.Lock()
+	defer p.serveMu.Unlock()
+	if p.closing {
+		return false
+	}
+	p.inflight.Add(1)
+	return true
+}
+
+// channel that is closed when shutdown begins
+func (p *Publisher) shutdownChan() chan struct{} {
+	p.serveMu.Lock()
+	defer p.serveMu.Unlock()
+	if p.shutdown == nil {
+		p.shutdown = make(chan struct{})
+	}
+	return p.shutdown
+}
+
+// Shutdown stops accepting new requests, completes the current segment so that clients streaming it can finish,
+// and waits for in-flight requests to drain before releasing all resources.
+// If ctx expires first, resources are released anyway and the context's error is returned.
+func (p *Publisher) Shutdown(ctx context.Context) error {
+	shutdown := p.shutdownChan()
+	p.serveMu.Lock()
+	if !p.closing {
+		p.closing = true
+		close(shutdown)
+	}
+	p.serveMu.Unlock()
+	p.mu.Lock()
+	err := p.endCurrent()
+	p.mu.Unlock()
+	idle := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.Close()
+	return err
+}
+
+// Close frees resources associated with the publisher. It is safe to call more than once.
 func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLoop()
+	if p.Recorder != nil {
+		p.Recorder.tap(p.Recorder.WriteTrailer)
+	}
 	p.state.Store(hlsState{})
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+	if p.queue != nil {
+		// finish writing before anything is released
+		p.queue.wait()
+		p.queue.close()
+		p.queue = nil
+	}
 	p.current = nil
 	for _, seg := range p.segments {
 		seg.Release()
@@ -262,4 +1932,6 @@ func (p *Publisher) Close() {
 		seg.Release()
 	}
 	p.presegs = nil
+	atomic.StoreInt64(&p.stats.active, 0)
+	p.closeSubs()
 }
@@ -0,0 +1,322 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+// durations of the segments in a playlist, in seconds
+func extinfs(t *testing.T, playlist []byte) []float64 {
+	t.Helper()
+	var durs []float64
+	sc := bufio.NewScanner(bytes.NewReader(playlist))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "#EXTINF:") {
+			continue
+		}
+		v := strings.TrimSuffix(strings.TrimPrefix(line, "#EXTINF:"), ",")
+		if i := strings.IndexByte(v, ','); i >= 0 {
+			v = v[:i]
+		}
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			t.Fatalf("bad EXTINF %q: %v", line, err)
+		}
+		durs = append(durs, d)
+	}
+	return durs
+}
+
+// value of a playlist tag such as #EXT-X-TARGETDURATION
+func tagValue(playlist []byte, tag string) string {
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if strings.HasPrefix(line, tag+":") {
+			return strings.TrimPrefix(line, tag+":")
+		}
+	}
+	return ""
+}
+
+func TestAudioOnlySegmentDuration(t *testing.T) {
+	p := &Publisher{InMemory: true, InitialDuration: 5 * time.Second, BufferLength: 2 * time.Minute}
+	defer p.Close()
+	if err := (hlstest.Source{NoVideo: true, Duration: time.Minute}).WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	pl := p.Playlist()
+	durs := extinfs(t, pl)
+	if len(durs) < 10 {
+		t.Fatalf("expected at least 10 segments, got %d", len(durs))
+	}
+	for i, d := range durs {
+		if d > 5 {
+			t.Errorf("segment %d is %.3fs, longer than the initial target of 5s", i, d)
+		}
+	}
+	if target := tagValue(pl, "#EXT-X-TARGETDURATION"); target != "5" {
+		t.Errorf("target duration grew to %s", target)
+	}
+}
+
+func TestTargetCoversFinalSegment(t *testing.T) {
+	p := &Publisher{InMemory: true, InitialDuration: 2 * time.Second}
+	defer p.Close()
+	// regular 2s GOPs, then a 7s stretch without keyframes that ends the stream
+	src := hlstest.Source{KeyframeInterval: 2 * time.Second, Duration: 10 * time.Second}
+	tail := hlstest.Source{KeyframeInterval: time.Minute, Duration: 7 * time.Second, Start: 10 * time.Second}
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range append(src.Packets(), tail.Packets()...) {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	pl := p.Playlist()
+	var longest float64
+	for _, d := range extinfs(t, pl) {
+		longest = math.Max(longest, d)
+	}
+	if longest < 6 {
+		t.Fatalf("expected a long final segment, longest is %.3fs", longest)
+	}
+	target, err := strconv.Atoi(tagValue(pl, "#EXT-X-TARGETDURATION"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if float64(target) < math.Ceil(longest) {
+		t.Errorf("target duration %d is less than the final segment's %.3fs", target, longest)
+	}
+}
+
+func TestPartsWithinTarget(t *testing.T) {
+	p := &Publisher{InMemory: true, PartDuration: 200 * time.Millisecond, BufferLength: time.Minute}
+	defer p.Close()
+	// 24 fps doesn't divide into 200ms parts
+	if err := (hlstest.Source{FPS: 24, Duration: 10 * time.Second}).WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	pl := p.Playlist()
+	target, err := strconv.ParseFloat(strings.TrimPrefix(tagValue(pl, "#EXT-X-PART-INF"), "PART-TARGET="), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts int
+	for _, line := range strings.Split(string(pl), "\n") {
+		if !strings.HasPrefix(line, "#EXT-X-PART:DURATION=") {
+			continue
+		}
+		parts++
+		v := strings.TrimPrefix(line, "#EXT-X-PART:DURATION=")
+		d, err := strconv.ParseFloat(v[:strings.IndexByte(v, ',')], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d > target {
+			t.Errorf("part is %.3fs, longer than PART-TARGET=%.3f", d, target)
+		}
+	}
+	if parts == 0 {
+		t.Fatal("no parts listed")
+	}
+}
+
+func TestWriteAfterEnded(t *testing.T) {
+	p := &Publisher{InMemory: true, PlaylistType: PlaylistEvent}
+	defer p.Close()
+	src := hlstest.Source{Duration: 5 * time.Second}
+	if err := src.WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(p.Playlist(), []byte("#EXT-X-ENDLIST")) {
+		t.Fatal("playlist was not ended")
+	}
+	pkt := src.Packets()[0]
+	pkt.Time += time.Minute
+	if err := p.WritePacket(pkt); err != ErrEnded {
+		t.Errorf("expected ErrEnded, got %v", err)
+	}
+}
+
+// building the playlist snapshot, as done at every segment and part boundary
+func BenchmarkPublish(b *testing.B) {
+	p := &Publisher{InMemory: true, BufferLength: time.Minute}
+	defer p.Close()
+	src := hlstest.Source{KeyframeInterval: time.Second, Duration: time.Minute}
+	if err := src.WriteAll(p); err != nil {
+		b.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.publish()
+	}
+}
+
+func TestResolutionChangeDiscontinuity(t *testing.T) {
+	p := &Publisher{InMemory: true}
+	defer p.Close()
+	first := hlstest.Source{Width: 320, Height: 240, Duration: 6 * time.Second}
+	second := hlstest.Source{Width: 640, Height: 480, Duration: 6 * time.Second, Start: 6 * time.Second}
+	for _, src := range []hlstest.Source{first, second} {
+		streams, err := src.Streams()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.WriteHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+		for _, pkt := range src.Packets() {
+			if err := p.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := p.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	pl := string(p.Playlist())
+	if n := strings.Count(pl, "#EXT-X-DISCONTINUITY\n"); n != 1 {
+		t.Errorf("expected one discontinuity at the resolution change, got %d:\n%s", n, pl)
+	}
+	// the discontinuity comes after the segments of the first stream
+	if i := strings.Index(pl, "#EXT-X-DISCONTINUITY\n"); i >= 0 && !strings.Contains(pl[:i], "#EXTINF:") {
+		t.Errorf("discontinuity is before the first segment:\n%s", pl)
+	}
+}
+
+func TestPrecreateIsLazy(t *testing.T) {
+	p := &Publisher{InMemory: true, Prefetch: true, Precreate: 20}
+	defer p.Close()
+	src := hlstest.Source{Duration: 12 * time.Second}
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range src.Packets() {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the live segment plus the precreated ones
+	if n := strings.Count(string(p.Playlist()), "#EXT-X-PREFETCH:"); n != 21 {
+		t.Errorf("expected 21 prefetch entries, got %d", n)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.presegs) != 20 {
+		t.Fatalf("expected 20 precreated segments, got %d", len(p.presegs))
+	}
+	for _, seg := range p.presegs {
+		seg.mu.Lock()
+		if seg.buf != nil || seg.size != 0 {
+			t.Errorf("precreated segment %s holds %d bytes of storage before it is used", seg.name, seg.size)
+		}
+		seg.mu.Unlock()
+	}
+}
+
+func TestSetPrecreateRequiresPrefetch(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		p := &Publisher{InMemory: true, Prefetch: prefetch}
+		src := hlstest.Source{Duration: 12 * time.Second}
+		streams, err := src.Streams()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.WriteHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+		p.SetPrecreate(3)
+		for _, pkt := range src.Packets() {
+			if err := p.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := 0
+		if prefetch {
+			want = 3
+		}
+		p.mu.Lock()
+		if p.Precreate != want || len(p.presegs) != want {
+			t.Errorf("Prefetch=%v: got Precreate=%d with %d precreated segments, expected %d", prefetch, p.Precreate, len(p.presegs), want)
+		}
+		p.mu.Unlock()
+		if err := p.Validate(); err != nil {
+			t.Errorf("Prefetch=%v: %v", prefetch, err)
+		}
+		p.Close()
+	}
+}
+
+func TestSegmentNameFuncRejectsPaths(t *testing.T) {
+	for _, name := range []string{"../seg", "dir/seg", `dir\seg`, "..", ""} {
+		p := &Publisher{InMemory: true, SegmentNameFunc: func(int64) string { return name }}
+		if err := (hlstest.Source{Duration: 4 * time.Second}).WriteAll(p); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+		p.Close()
+	}
+}
+
+func TestDiscontinuityRebases(t *testing.T) {
+	p := &Publisher{InMemory: true, RebaseTimestamps: true, InitialDuration: 2 * time.Second}
+	defer p.Close()
+	first := hlstest.Source{Duration: 10 * time.Second, Start: 100 * time.Second}
+	// the source restarts its clock after the discontinuity
+	second := hlstest.Source{Duration: 10 * time.Second}
+	streams, err := first.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for i, src := range []hlstest.Source{first, second} {
+		if i != 0 {
+			p.Discontinuity()
+		}
+		for _, pkt := range src.Packets() {
+			if err := p.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := p.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	pl := p.Playlist()
+	var total float64
+	for i, d := range extinfs(t, pl) {
+		if d <= 0 || d > 3 {
+			t.Errorf("segment %d is %.3fs", i, d)
+		}
+		total += d
+	}
+	if total < 19 || total > 21 {
+		t.Errorf("segments add up to %.3fs, expected about 20s", total)
+	}
+	if n := strings.Count(string(pl), "#EXT-X-DISCONTINUITY\n"); n != 1 {
+		t.Errorf("expected one discontinuity, got %d", n)
+	}
+}
@@ -0,0 +1,246 @@
+// Package hlstest provides a synthetic H.264 and AAC source for exercising a Publisher in tests.
+package hlstest
+
+import (
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// Source generates a stream of fake packets with realistic timestamps and valid codec data.
+// The packet payloads are correctly framed but not decodable, so the output is suitable for segmenting and
+// serving but not for playback.
+type Source struct {
+	// Width and Height are the video dimensions, rounded down to a multiple of 16. Defaults to 320x240.
+	Width, Height int
+	// FPS is the video frame rate. Defaults to 30.
+	FPS int
+	// KeyframeInterval is the time between video keyframes. Defaults to 2 seconds.
+	KeyframeInterval time.Duration
+	// Duration is the length of the stream. Defaults to 10 seconds.
+	Duration time.Duration
+	// Start is the timestamp of the first packet
+	Start time.Duration
+	// SampleRate is the audio sample rate. Defaults to 48000.
+	SampleRate int
+	// NoVideo and NoAudio leave out a stream
+	NoVideo, NoAudio bool
+}
+
+// size of each packet payload, including framing
+const (
+	keyframeSize = 10000
+	frameSize    = 2000
+	audioSize    = 256
+)
+
+func (s Source) defaults() Source {
+	if s.Width < 16 || s.Height < 16 {
+		s.Width, s.Height = 320, 240
+	}
+	s.Width -= s.Width % 16
+	s.Height -= s.Height % 16
+	if s.FPS <= 0 {
+		s.FPS = 30
+	}
+	if s.KeyframeInterval <= 0 {
+		s.KeyframeInterval = 2 * time.Second
+	}
+	if s.Duration <= 0 {
+		s.Duration = 10 * time.Second
+	}
+	if s.SampleRate <= 0 {
+		s.SampleRate = 48000
+	}
+	return s
+}
+
+// Streams returns the codec data of the video stream followed by the audio stream
+func (s Source) Streams() ([]av.CodecData, error) {
+	s = s.defaults()
+	var streams []av.CodecData
+	if !s.NoVideo {
+		cd, err := h264parser.NewCodecDataFromSPSAndPPS(sps(s.Width, s.Height), pps())
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, cd)
+	}
+	if !s.NoAudio {
+		cd, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+			ObjectType:    aacparser.AOT_AAC_LC,
+			SampleRate:    s.SampleRate,
+			ChannelLayout: av.CH_STEREO,
+		})
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, cd)
+	}
+	return streams, nil
+}
+
+// Packets returns every packet of the stream, interleaved in timestamp order
+func (s Source) Packets() []av.Packet {
+	s = s.defaults()
+	var pkts []av.Packet
+	frameDur := time.Second / time.Duration(s.FPS)
+	// AAC frames hold 1024 samples
+	audioDur := 1024 * time.Second / time.Duration(s.SampleRate)
+	var video, audio int
+	var lastKey time.Duration
+	for {
+		vt := time.Duration(video) * frameDur
+		at := time.Duration(audio) * audioDur
+		doVideo := !s.NoVideo && vt < s.Duration
+		doAudio := !s.NoAudio && at < s.Duration
+		if doVideo && doAudio {
+			// video first on ties, so that segments start on a keyframe
+			doAudio = at < vt
+			doVideo = !doAudio
+		}
+		switch {
+		case doVideo:
+			key := video == 0 || vt-lastKey >= s.KeyframeInterval
+			if key {
+				lastKey = vt
+			}
+			pkts = append(pkts, av.Packet{Idx: 0, Time: s.Start + vt, IsKeyFrame: key, Data: videoFrame(key)})
+			video++
+		case doAudio:
+			var idx int8
+			if !s.NoVideo {
+				idx = 1
+			}
+			pkts = append(pkts, av.Packet{Idx: idx, Time: s.Start + at, Data: make([]byte, audioSize)})
+			audio++
+		default:
+			return pkts
+		}
+	}
+}
+
+// WriteAll writes the whole stream to m, e.g. a Publisher, including the header and trailer
+func (s Source) WriteAll(m av.Muxer) error {
+	streams, err := s.Streams()
+	if err != nil {
+		return err
+	}
+	if err := m.WriteHeader(streams); err != nil {
+		return err
+	}
+	for _, pkt := range s.Packets() {
+		if err := m.WritePacket(pkt); err != nil {
+			return err
+		}
+	}
+	return m.WriteTrailer()
+}
+
+// a single AVCC framed slice NALU
+func videoFrame(key bool) []byte {
+	size, header := frameSize, byte(0x41)
+	if key {
+		size, header = keyframeSize, 0x65
+	}
+	b := make([]byte, size)
+	n := size - 4
+	b[0], b[1], b[2], b[3] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+	b[4] = header
+	return b
+}
+
+// constrained baseline sequence parameter set for the given dimensions
+func sps(width, height int) []byte {
+	var w bitWriter
+	w.bits(66, 8) // profile_idc
+	w.bits(0xc0, 8)
+	w.bits(30, 8) // level_idc
+	w.ue(0)       // seq_parameter_set_id
+	w.ue(0)       // log2_max_frame_num_minus4
+	w.ue(2)       // pic_order_cnt_type
+	w.ue(1)       // max_num_ref_frames
+	w.bits(0, 1)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint(width/16 - 1))
+	w.ue(uint(height/16 - 1))
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(0, 1) // frame_cropping_flag
+	w.bits(0, 1) // vui_parameters_present_flag
+	return w.nalu(0x67)
+}
+
+// picture parameter set to go with sps
+func pps() []byte {
+	var w bitWriter
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bits(0, 1) // entropy_coding_mode_flag
+	w.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bits(0, 1) // weighted_pred_flag
+	w.bits(0, 2) // weighted_bipred_idc
+	w.ue(0)      // pic_init_qp_minus26
+	w.ue(0)      // pic_init_qs_minus26
+	w.ue(0)      // chroma_qp_index_offset
+	w.bits(1, 1) // deblocking_filter_control_present_flag
+	w.bits(0, 1) // constrained_intra_pred_flag
+	w.bits(0, 1) // redundant_pic_cnt_present_flag
+	return w.nalu(0x68)
+}
+
+// writes the RBSP of a parameter set
+type bitWriter struct {
+	b   []byte
+	cur byte
+	n   uint
+}
+
+func (w *bitWriter) bits(v uint, n uint) {
+	for i := n; i > 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>(i-1)&1)
+		w.n++
+		if w.n == 8 {
+			w.b = append(w.b, w.cur)
+			w.cur, w.n = 0, 0
+		}
+	}
+}
+
+// unsigned Exp-Golomb code
+func (w *bitWriter) ue(v uint) {
+	v++
+	var n uint
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// add trailing bits and emulation prevention, and prepend the NALU header
+func (w *bitWriter) nalu(header byte) []byte {
+	w.bits(1, 1)
+	for w.n != 0 {
+		w.bits(0, 1)
+	}
+	out := []byte{header}
+	var zeros int
+	for _, c := range w.b {
+		if zeros == 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
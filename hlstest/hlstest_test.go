@@ -0,0 +1,67 @@
+package hlstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+func TestPackets(t *testing.T) {
+	src := Source{FPS: 25, KeyframeInterval: time.Second, Duration: 4 * time.Second, Start: time.Minute}
+	pkts := src.Packets()
+	var video, audio, keys int
+	last := time.Duration(-1)
+	for i, pkt := range pkts {
+		if pkt.Time < last {
+			t.Fatalf("packet %d at %s is before the previous one at %s", i, pkt.Time, last)
+		}
+		last = pkt.Time
+		if pkt.Time < src.Start || pkt.Time >= src.Start+src.Duration {
+			t.Errorf("packet %d at %s is outside the stream", i, pkt.Time)
+		}
+		switch pkt.Idx {
+		case 0:
+			video++
+			if pkt.IsKeyFrame {
+				if (pkt.Time-src.Start)%time.Second != 0 {
+					t.Errorf("keyframe at %s is off the interval", pkt.Time)
+				}
+				keys++
+			}
+		case 1:
+			audio++
+			if pkt.IsKeyFrame {
+				t.Errorf("audio packet %d is marked as a keyframe", i)
+			}
+		}
+	}
+	if !pkts[0].IsKeyFrame {
+		t.Error("stream doesn't start with a keyframe")
+	}
+	if video != 100 || keys != 4 {
+		t.Errorf("got %d frames and %d keyframes, expected 100 and 4", video, keys)
+	}
+	// 48kHz with 1024 samples per frame
+	if audio != 188 {
+		t.Errorf("got %d audio frames, expected 188", audio)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	streams, err := Source{Width: 650, Height: 490, NoAudio: true}.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("expected only a video stream, got %d", len(streams))
+	}
+	cd, ok := streams[0].(h264parser.CodecData)
+	if !ok {
+		t.Fatalf("video stream is %T", streams[0])
+	}
+	// rounded down to whole macroblocks
+	if cd.Width() != 640 || cd.Height() != 480 {
+		t.Errorf("got %dx%d, expected 640x480", cd.Width(), cd.Height())
+	}
+}
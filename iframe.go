@@ -0,0 +1,63 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// location of a keyframe within a segment
+type iframe struct {
+	offset, size int64
+	time         time.Duration
+}
+
+// record the keyframe just written, which started at the given offset
+func (s *segment) addIFrame(t time.Duration, offset int64) {
+	s.iframes = append(s.iframes, iframe{offset: offset, size: s.written - offset, time: t})
+}
+
+// check if an I-frame playlist can be produced for this stream
+func (p *Publisher) iframesEnabled() bool {
+	return p.IFramePlaylist && !p.fmp4() && p.block == nil && p.vidx >= 0
+}
+
+// build the I-frame playlist from the completed segments, and return it with its peak bitrate
+func (p *Publisher) iframePlaylist() ([]byte, int) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:%d\n", int(p.targetDur.Seconds()))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.seq)
+	if p.dcnseq != 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.dcnseq)
+	}
+	b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	var peak int
+	for _, seg := range p.segments {
+		if !seg.final {
+			break
+		}
+		if seg.dcn {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		// each keyframe is decoded using the PAT and PMT at the start of the segment
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n", seg.name, seg.hdrLen)
+		for i, fr := range seg.iframes {
+			end := seg.start + seg.dur
+			if i+1 < len(seg.iframes) {
+				end = seg.iframes[i+1].time
+			}
+			dur := end - fr.time
+			if dur <= 0 {
+				continue
+			}
+			if bw := int(float64(fr.size*8) / dur.Seconds()); bw > peak {
+				peak = bw
+			}
+			fmt.Fprintf(&b, "#EXTINF:%s,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", formatSeconds(dur), fr.size, fr.offset, seg.name)
+		}
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes(), peak
+}
@@ -0,0 +1,124 @@
+package hls
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SegmentInfo describes a segment in the playlist
+type SegmentInfo struct {
+	// Name is the segment's file name as it appears in the playlist
+	Name string
+	// Sequence is the segment's media sequence number
+	Sequence int64
+	Duration time.Duration
+	// Size is the length of the segment in bytes
+	Size int64
+	// LiveEdge is true for the most recent segments, as counted by Publisher.PrimeSegments
+	LiveEdge bool
+
+	seg *segment
+}
+
+// Open returns a reader for the segment's contents.
+// Reading fails once the segment has been removed from the playlist, so slow consumers should copy it first.
+func (si SegmentInfo) Open() (io.Reader, error) {
+	s := si.seg
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf == nil {
+		return nil, errors.New("segment has been released")
+	}
+	return io.NewSectionReader(s.buf, 0, si.Size), nil
+}
+
+func (s *segment) info() SegmentInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SegmentInfo{
+		Name:     s.name,
+		Sequence: s.seq,
+		Duration: s.dur,
+		Size:     s.size,
+		seg:      s,
+	}
+}
+
+// Playlist returns a copy of the current media playlist, or nil if the stream hasn't started
+func (p *Publisher) Playlist() []byte {
+	state, _ := p.state.Load().(hlsState)
+	if state.playlist == nil {
+		return nil
+	}
+	return append([]byte(nil), state.playlist...)
+}
+
+// Healthy reports whether the stream is ready to be played: at least one segment is complete, and a new segment has
+// started within StaleAfter target durations, or 3 if StaleAfter isn't set. It is suitable for a readiness check.
+func (p *Publisher) Healthy() bool {
+	state, _ := p.state.Load().(hlsState)
+	if state.playlist == nil || atomic.LoadInt64(&p.stats.segments) == 0 {
+		return false
+	}
+	n := p.StaleAfter
+	if n <= 0 {
+		n = 3
+	}
+	return !p.idleFor(state, n)
+}
+
+// OpenSegment returns a reader for a complete segment in the playlist, given its name as it appears there.
+// The segment's contents remain available until the reader is closed, even if it leaves the playlist meanwhile.
+func (p *Publisher) OpenSegment(name string) (io.ReadCloser, error) {
+	state, _ := p.state.Load().(hlsState)
+	for _, seg := range state.segments[:state.listed] {
+		if seg.name != name {
+			continue
+		}
+		if !seg.acquire() {
+			break
+		}
+		seg.mu.Lock()
+		buf, size, final := seg.buf, seg.size, seg.final
+		seg.mu.Unlock()
+		if !final || buf == nil {
+			seg.unref()
+			return nil, errors.New("segment is not complete")
+		}
+		return &segmentReader{SectionReader: io.NewSectionReader(buf, 0, size), seg: seg}, nil
+	}
+	return nil, errors.New("segment not found")
+}
+
+// holds a reference to a segment until closed
+type segmentReader struct {
+	*io.SectionReader
+	seg  *segment
+	once sync.Once
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(r.seg.unref)
+	return nil
+}
+
+// MediaSequence returns the sequence number of the first segment in the playlist, as given by EXT-X-MEDIA-SEQUENCE
+func (p *Publisher) MediaSequence() int64 {
+	state, _ := p.state.Load().(hlsState)
+	return state.seq
+}
+
+// Segments describes the segments currently in the playlist, oldest first.
+// The last segment may still be in progress, in which case its duration is an estimate.
+func (p *Publisher) Segments() []SegmentInfo {
+	state, _ := p.state.Load().(hlsState)
+	infos := make([]SegmentInfo, state.listed)
+	for i, seg := range state.segments[:state.listed] {
+		infos[i] = seg.info()
+		infos[i].LiveEdge = p.atEdge(state, i)
+	}
+	return infos
+}
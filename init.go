@@ -0,0 +1,43 @@
+package hls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// an fMP4 init segment, named after its contents so that it never changes under a given URL
+type initSegment struct {
+	name string
+	data []byte
+}
+
+// init segments can be cached indefinitely, since new track setup gets a new name
+const initCache = "public, max-age=31536000, immutable"
+
+func newInitSegment(data []byte) *initSegment {
+	sum := sha256.Sum256(data)
+	return &initSegment{name: "init-" + hex.EncodeToString(sum[:8]) + ".mp4", data: data}
+}
+
+// EXT-X-MAP tag for a segment, if it uses a different init segment than the one before it
+func mapTag(prev, cur *initSegment) string {
+	if cur == nil || cur == prev {
+		return ""
+	}
+	return fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", cur.name)
+}
+
+// find an init segment referenced by the playlist
+func (state hlsState) initSegment(name string) *initSegment {
+	if state.init != nil && state.init.name == name {
+		return state.init
+	}
+	// precreated segments get their init segment when they start, so only listed ones are searched
+	for _, seg := range state.segments[:state.listed] {
+		if seg.init != nil && seg.init.name == name {
+			return seg.init
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package adtsfrag
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+)
+
+// Fragmenter writes packed audio segments: ADTS frames preceded by an ID3 tag giving the timestamp of the first
+type Fragmenter struct {
+	w       io.Writer
+	config  aacparser.MPEG4AudioConfig
+	needID3 bool
+	buf     []byte
+}
+
+func New(streams []av.CodecData) (*Fragmenter, error) {
+	if len(streams) != 1 {
+		return nil, errors.New("packed audio segments carry a single audio stream")
+	}
+	cd, ok := streams[0].(aacparser.CodecData)
+	if !ok {
+		return nil, errors.New("packed audio segments carry AAC only")
+	}
+	return &Fragmenter{config: cd.Config}, nil
+}
+
+// SetWriter starts writing a new segment to w
+func (f *Fragmenter) SetWriter(w io.Writer) error {
+	f.w = w
+	f.needID3 = true
+	return nil
+}
+
+// WritePacket frames a raw AAC packet with an ADTS header and writes it out
+func (f *Fragmenter) WritePacket(pkt av.Packet) error {
+	if f.w == nil {
+		return errors.New("output is not set")
+	}
+	f.buf = f.buf[:0]
+	if f.needID3 {
+		f.buf = appendTimestamp(f.buf, pkt.Time)
+		f.needID3 = false
+	}
+	n := len(f.buf)
+	f.buf = append(f.buf, make([]byte, aacparser.ADTSHeaderLength)...)
+	aacparser.FillADTSHeader(f.buf[n:], f.config, 1024, len(pkt.Data))
+	f.buf = append(f.buf, pkt.Data...)
+	_, err := f.w.Write(f.buf)
+	return err
+}
+
+// Flush is unused
+func (f *Fragmenter) Flush(next time.Duration) error {
+	return nil
+}
+
+// FileHeader is unused
+func (f *Fragmenter) FileHeader() []byte {
+	return nil
+}
+
+const timestampOwner = "com.apple.streaming.transportStreamTimestamp"
+
+// append an ID3v2.4 tag with a PRIV frame holding the 33-bit MPEG-2 timestamp of t, as required at the start of
+// every packed audio segment
+func appendTimestamp(b []byte, t time.Duration) []byte {
+	frameLen := len(timestampOwner) + 1 + 8
+	b = append(b, 'I', 'D', '3', 4, 0, 0)
+	b = appendSyncsafe(b, 10+frameLen)
+	b = append(b, 'P', 'R', 'I', 'V')
+	b = appendSyncsafe(b, frameLen)
+	b = append(b, 0, 0)
+	b = append(b, timestampOwner...)
+	b = append(b, 0)
+	var ts [8]byte
+	pts := uint64(t*90000/time.Second) & (1<<33 - 1)
+	binary.BigEndian.PutUint64(ts[:], pts)
+	return append(b, ts[:]...)
+}
+
+// ID3 sizes use 7 bits per byte
+func appendSyncsafe(b []byte, n int) []byte {
+	return append(b, byte(n>>21&0x7f), byte(n>>14&0x7f), byte(n>>7&0x7f), byte(n&0x7f))
+}
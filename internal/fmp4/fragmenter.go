@@ -87,12 +87,17 @@ func (f *Fragmenter) FileHeader() []byte {
 
 // Flush accumulated packets into a new fragment and write it out.
 // The time of the next video packet following all of those in the fragment must be provided.
+// Streams without pending packets are left out of the fragment, so that it can stand alone as a CMAF chunk.
 func (f *Fragmenter) Flush(next time.Duration) error {
+	var streams []*fragStream
 	for _, s := range f.streams {
-		if len(s.pending) == 0 {
-			return nil
+		if len(s.pending) != 0 {
+			streams = append(streams, s)
 		}
 	}
+	if len(streams) == 0 {
+		return nil
+	}
 	moof := &fmp4io.MovieFrag{
 		Header: &fmp4io.MovieFragHeader{
 			Seqnum: f.seqNum,
@@ -102,7 +107,7 @@ func (f *Fragmenter) Flush(next time.Duration) error {
 	// create track metadata
 	var offsets []uint32
 	var mdatLen uint32
-	for _, s := range f.streams {
+	for _, s := range streams {
 		track, err := s.makeFragment(next)
 		if err != nil {
 			return err
@@ -126,7 +131,7 @@ func (f *Fragmenter) Flush(next time.Duration) error {
 	n += 4
 	pio.PutU32BE(b[n:], uint32(fmp4io.MDAT))
 	n += 4
-	for _, s := range f.streams {
+	for _, s := range streams {
 		for _, pkt := range s.pending {
 			copy(b[n:], pkt.Data)
 			n += len(pkt.Data)
@@ -3,6 +3,7 @@ package tsfrag
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"time"
 
@@ -11,26 +12,49 @@ import (
 )
 
 type Fragmenter struct {
-	w      io.Writer
+	// PSIInterval, if set, repeats the PAT and PMT within a segment this often
+	PSIInterval time.Duration
+
+	w io.Writer
+	// scratch buffer for muxer output, reused for every packet since its contents are copied when written out
 	buf    bytes.Buffer
 	header []byte
 	mux    *ts.Muxer
+
+	// time of the last packet preceded by a PAT and PMT, if any in this segment
+	psiTime time.Duration
+	psiSet  bool
 }
 
 func New(streams []av.CodecData) (*Fragmenter, error) {
+	for _, cd := range streams {
+		if !supported(cd.Type()) {
+			// the muxer would fail anyway, but say why
+			return nil, fmt.Errorf("codec %v can't be carried in MPEG-TS segments; use fMP4 instead", cd.Type())
+		}
+	}
 	f := new(Fragmenter)
 	f.mux = ts.NewMuxer(&f.buf)
 	if err := f.mux.WriteHeader(streams); err != nil {
 		return nil, err
 	}
-	f.header = make([]byte, f.buf.Len())
-	copy(f.header, f.buf.Bytes())
+	f.header = append([]byte(nil), f.buf.Bytes()...)
 	return f, nil
 }
 
+func supported(t av.CodecType) bool {
+	for _, ct := range ts.CodecTypes {
+		if ct == t {
+			return true
+		}
+	}
+	return false
+}
+
 // SetWriter starts writing a new segment to w
 func (f *Fragmenter) SetWriter(w io.Writer) error {
 	f.w = w
+	f.psiSet = false
 	_, err := w.Write(f.header)
 	return err
 }
@@ -41,6 +65,17 @@ func (f *Fragmenter) WritePacket(pkt av.Packet) error {
 		return errors.New("output is not set")
 	}
 	f.buf.Reset()
+	if f.PSIInterval > 0 {
+		if !f.psiSet {
+			// the segment header counts as the first
+			f.psiTime, f.psiSet = pkt.Time, true
+		} else if pkt.Time-f.psiTime >= f.PSIInterval {
+			if err := f.mux.WritePATPMT(); err != nil {
+				return err
+			}
+			f.psiTime = pkt.Time
+		}
+	}
 	if err := f.mux.WritePacket(pkt); err != nil {
 		return err
 	}
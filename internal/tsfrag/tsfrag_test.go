@@ -0,0 +1,31 @@
+package tsfrag
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+func BenchmarkWritePacket(b *testing.B) {
+	src := hlstest.Source{Width: 1920, Height: 1080, FPS: 30}
+	streams, err := src.Streams()
+	if err != nil {
+		b.Fatal(err)
+	}
+	pkts := src.Packets()
+	f, err := New(streams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.SetWriter(ioutil.Discard); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f.WritePacket(pkts[i%len(pkts)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package hls
+
+import (
+	"sync/atomic"
+
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// H.264 NAL unit types
+const (
+	naluIDR = 5
+	naluSEI = 6
+)
+
+// SEI payload type of a recovery point
+const seiRecoveryPoint = 6
+
+// check that an H.264 frame flagged as a keyframe can really start a segment
+func (p *Publisher) checkKeyframe(data []byte) bool {
+	nalus, _ := h264parser.SplitNALUs(data)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluIDR:
+			return true
+		case naluSEI:
+			if p.AcceptRecoveryPoints && hasRecoveryPoint(nalu[1:]) {
+				return true
+			}
+		}
+	}
+	atomic.AddInt64(&p.stats.pseudoKeys, 1)
+	return false
+}
+
+// check if an SEI NAL unit's payload carries a recovery point message
+func hasRecoveryPoint(b []byte) bool {
+	for len(b) > 0 && b[0] != 0x80 {
+		var typ, size int
+		for len(b) > 0 && b[0] == 0xff {
+			typ += 0xff
+			b = b[1:]
+		}
+		if len(b) == 0 {
+			return false
+		}
+		typ += int(b[0])
+		b = b[1:]
+		for len(b) > 0 && b[0] == 0xff {
+			size += 0xff
+			b = b[1:]
+		}
+		if len(b) == 0 {
+			return false
+		}
+		size += int(b[0])
+		b = b[1:]
+		if typ == seiRecoveryPoint {
+			return true
+		}
+		if size > len(b) {
+			return false
+		}
+		b = b[size:]
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package hls
+
+// Logger receives diagnostic messages about a stream. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// log a diagnostic message, if a Logger is set
+func (p *Publisher) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+	}
+}
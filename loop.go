@@ -0,0 +1,79 @@
+package hls
+
+import (
+	"io"
+	"time"
+)
+
+// start replaying the completed segments after the content ends. Must be called with the lock held.
+func (p *Publisher) startLoop() {
+	p.stopLoop()
+	var segs []*segment
+	for _, seg := range p.segments {
+		// hold a reference so the contents outlive the originals being trimmed
+		if seg.final && !seg.gap && seg.acquire() {
+			segs = append(segs, seg)
+		}
+	}
+	if len(segs) == 0 {
+		return
+	}
+	p.loopStop = make(chan struct{})
+	go p.runLoop(segs, p.loopStop)
+}
+
+// stop replaying segments. Must be called with the lock held.
+func (p *Publisher) stopLoop() {
+	if p.loopStop != nil {
+		close(p.loopStop)
+		p.loopStop = nil
+	}
+}
+
+// add copies of the looped segments to the playlist in real time until stopped
+func (p *Publisher) runLoop(segs []*segment, stop chan struct{}) {
+	defer func() {
+		for _, seg := range segs {
+			seg.unref()
+		}
+	}()
+	for {
+		for i, seg := range segs {
+			if !p.replay(seg, i == 0, stop) {
+				return
+			}
+			// the next segment is due once this one has played out
+			t := time.NewTimer(seg.dur)
+			select {
+			case <-stop:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// add a copy of a looped segment, or report false if looping has stopped
+func (p *Publisher) replay(seg *segment, first bool, stop chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	if first {
+		// timestamps jump back to the start of the content
+		p.dcn = true
+	}
+	seg.mu.Lock()
+	r := io.NewSectionReader(seg.buf, 0, seg.size)
+	seg.mu.Unlock()
+	if err := p.pushSegment(r, seg.dur, seg.indep); err != nil {
+		p.logf("hls: replaying segment %s failed, no longer looping: %v", seg.name, err)
+		p.loopStop = nil
+		return false
+	}
+	return true
+}
@@ -0,0 +1,345 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// MasterPlaylist serves a multivariant playlist tying together several renditions of the same content.
+//
+// The multivariant playlist is served as index.m3u8, and each variant is served beneath a directory named after it,
+// e.g. 720p/index.m3u8 and its segments.
+type MasterPlaylist struct {
+	mu         sync.RWMutex
+	variants   []Variant
+	renditions []Rendition
+}
+
+// Variant describes one rendition in a MasterPlaylist
+type Variant struct {
+	// Name is the directory the variant is served from
+	Name      string
+	Publisher *Publisher
+	// Bandwidth is the peak bitrate of the variant in bits per second. If zero, the bitrate measured by the publisher is used,
+	// and the variant is left out until a segment has been measured.
+	Bandwidth int
+	// Width, Height, Codecs and FrameRate override the values derived from the streams passed to the publisher's WriteHeader
+	Width, Height int
+	Codecs        string
+	FrameRate     float64
+	// Subtitles is the GROUP-ID of the subtitle renditions offered with this variant
+	Subtitles string
+	// Audio is the GROUP-ID of the alternative audio renditions offered with this variant.
+	// Their codecs and bitrate are included in the variant's attributes unless overridden.
+	Audio string
+}
+
+// a sibling variant whose state is reported in a variant's playlist
+type peer struct {
+	uri string
+	pub *Publisher
+}
+
+// tell each variant about its siblings. Must be called with the lock held.
+func (m *MasterPlaylist) linkPeers() {
+	for _, v := range m.variants {
+		var peers []peer
+		for _, other := range m.variants {
+			if other.Publisher != v.Publisher {
+				peers = append(peers, peer{uri: "../" + other.Name + "/" + other.Publisher.PlaylistName(), pub: other.Publisher})
+			}
+		}
+		v.Publisher.peers.Store(peers)
+	}
+}
+
+// Rendition is an alternative track in a MasterPlaylist, served beneath a directory named after it.
+//
+// Audio renditions are separate audio-only publishers. Players align them with the video using timestamps rather than
+// segment boundaries, so every rendition must be fed packets with the same timestamp base as the video, normally by
+// demuxing them from the same source. Their segments should also be of similar duration to the video's.
+type Rendition struct {
+	// Name is the directory the rendition is served from, and the name shown to viewers
+	Name string
+	// Group is the GROUP-ID that variants refer to the rendition by
+	Group    string
+	Language string
+	Default  bool
+	// Subtitles serves a subtitle rendition
+	Subtitles *SubtitlePublisher
+	// Audio serves an audio rendition
+	Audio *Publisher
+}
+
+// AddRendition adds an alternative track to the multivariant playlist, replacing any existing one with the same name
+func (m *MasterPlaylist) AddRendition(r Rendition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.renditions {
+		if existing.Name == r.Name {
+			m.renditions[i] = r
+			return
+		}
+	}
+	m.renditions = append(m.renditions, r)
+}
+
+// RemoveRendition removes an alternative track from the multivariant playlist
+func (m *MasterPlaylist) RemoveRendition(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.renditions {
+		if existing.Name == name {
+			m.renditions = append(m.renditions[:i], m.renditions[i+1:]...)
+			return
+		}
+	}
+}
+
+// EXT-X-MEDIA tag for a rendition
+func (r Rendition) media() string {
+	var b strings.Builder
+	typ := "SUBTITLES"
+	if r.Audio != nil {
+		typ = "AUDIO"
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=%s,GROUP-ID=\"%s\",NAME=\"%s\"", typ, r.Group, r.Name)
+	if r.Language != "" {
+		fmt.Fprintf(&b, ",LANGUAGE=\"%s\"", r.Language)
+	}
+	if r.Default {
+		b.WriteString(",DEFAULT=YES")
+	}
+	uri := "index.m3u8"
+	if r.Audio != nil {
+		uri = r.Audio.PlaylistName()
+	}
+	fmt.Fprintf(&b, ",AUTOSELECT=YES,URI=\"%s/%s\"\n", r.Name, uri)
+	return b.String()
+}
+
+// AddVariant adds a rendition to the multivariant playlist, replacing any existing one with the same name
+func (m *MasterPlaylist) AddVariant(v Variant) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.variants {
+		if existing.Name == v.Name {
+			existing.Publisher.peers.Store([]peer(nil))
+			m.variants[i] = v
+			m.linkPeers()
+			return
+		}
+	}
+	m.variants = append(m.variants, v)
+	m.linkPeers()
+}
+
+// RemoveVariant removes a rendition from the multivariant playlist
+func (m *MasterPlaylist) RemoveVariant(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.variants {
+		if existing.Name == name {
+			existing.Publisher.peers.Store([]peer(nil))
+			m.variants = append(m.variants[:i], m.variants[i+1:]...)
+			m.linkPeers()
+			return
+		}
+	}
+}
+
+// build the multivariant playlist from the current state of each variant
+func (m *MasterPlaylist) playlist() []byte {
+	var b bytes.Buffer
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, v := range m.variants {
+		state, ok := v.Publisher.state.Load().(hlsState)
+		if !ok || state.playlist == nil {
+			// not started yet
+			continue
+		}
+		info := state.info
+		if v.Width != 0 {
+			info.width, info.height = v.Width, v.Height
+		}
+		peak, avg := state.peakBitrate, state.avgBitrate
+		if v.Audio != "" {
+			// account for the audio group
+			audio := m.audioState(v.Audio)
+			if audio.info.codecs != "" && info.codecs != "" {
+				info.codecs += "," + audio.info.codecs
+			}
+			peak += audio.peakBitrate
+			avg += audio.avgBitrate
+		}
+		if v.Bandwidth == 0 && peak == 0 {
+			// BANDWIDTH=0 is invalid, so wait until a segment has been measured
+			continue
+		}
+		if v.Codecs != "" {
+			info.codecs = v.Codecs
+		}
+		if v.FrameRate != 0 {
+			info.frameRate = v.FrameRate
+		}
+		if b.Len() == 0 {
+			b.WriteString("#EXTM3U\n")
+			for _, r := range m.renditions {
+				b.WriteString(r.media())
+			}
+		}
+		if v.Bandwidth != 0 {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+		} else {
+			// use the measured bitrate
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", peak)
+			if avg != 0 {
+				fmt.Fprintf(&b, ",AVERAGE-BANDWIDTH=%d", avg)
+			}
+		}
+		if info.width != 0 && info.height != 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", info.width, info.height)
+		}
+		if info.codecs != "" {
+			fmt.Fprintf(&b, ",CODECS=\"%s\"", info.codecs)
+		}
+		if info.frameRate != 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", info.frameRate)
+		}
+		if v.Audio != "" {
+			fmt.Fprintf(&b, ",AUDIO=\"%s\"", v.Audio)
+		}
+		if v.Subtitles != "" {
+			fmt.Fprintf(&b, ",SUBTITLES=\"%s\"", v.Subtitles)
+		}
+		fmt.Fprintf(&b, "\n%s/%s\n", v.Name, v.Publisher.PlaylistName())
+		if state.iframes != nil {
+			fmt.Fprintf(&b, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d", state.iframeBandwidth)
+			if info.width != 0 && info.height != 0 {
+				fmt.Fprintf(&b, ",RESOLUTION=%dx%d", info.width, info.height)
+			}
+			if info.videoCodec != "" {
+				fmt.Fprintf(&b, ",CODECS=\"%s\"", info.videoCodec)
+			}
+			fmt.Fprintf(&b, ",URI=\"%s/iframes.m3u8\"\n", v.Name)
+		}
+	}
+	return b.Bytes()
+}
+
+// state of the highest bitrate started rendition in an audio group. Must be called with the lock held.
+func (m *MasterPlaylist) audioState(group string) hlsState {
+	var best hlsState
+	for _, r := range m.renditions {
+		if r.Group != group || r.Audio == nil {
+			continue
+		}
+		if state, ok := r.Audio.state.Load().(hlsState); ok && state.peakBitrate >= best.peakBitrate {
+			best = state
+		}
+	}
+	return best
+}
+
+// find the variant a request path belongs to
+func (m *MasterPlaylist) variant(name string) *Publisher {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, v := range m.variants {
+		if v.Name == name {
+			return v.Publisher
+		}
+	}
+	return nil
+}
+
+// publisher whose CORS and content type settings apply to the multivariant playlist, if there are any variants
+func (m *MasterPlaylist) first() *Publisher {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.variants) == 0 {
+		return nil
+	}
+	return m.variants[0].Publisher
+}
+
+// find the rendition a request path belongs to
+func (m *MasterPlaylist) rendition(name string) http.Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.renditions {
+		if r.Name != name {
+			continue
+		}
+		if r.Audio != nil {
+			return r.Audio
+		}
+		if r.Subtitles != nil {
+			return r.Subtitles
+		}
+	}
+	return nil
+}
+
+// serve the multivariant playlist, and delegate variant playlists and segments to their publisher
+func (m *MasterPlaylist) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	dir, bn := path.Split(path.Clean(req.URL.Path))
+	if p := m.variant(path.Base(dir)); p != nil {
+		p.ServeHTTP(rw, req)
+		return
+	}
+	if h := m.rendition(path.Base(dir)); h != nil {
+		h.ServeHTTP(rw, req)
+		return
+	}
+	if bn != "index.m3u8" {
+		http.NotFound(rw, req)
+		return
+	}
+	ctype := mimeType(bn)
+	p := m.first()
+	if p != nil {
+		if p.setCORS(rw, req) && req.Method == http.MethodOptions {
+			// preflight
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ctype = p.playlistContentType()
+	}
+	b := m.playlist()
+	if len(b) == 0 {
+		if p == nil || p.NotFoundBeforeStart {
+			http.NotFound(rw, req)
+			return
+		}
+		// variants are listed once their bitrate is measured, so ask the player to try again shortly
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "bitrate not measured yet", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("Content-Type", ctype)
+	// variants appear once their bitrate is measured, so caches must revalidate like media playlists
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Write(b)
+}
+
+// add EXT-X-RENDITION-REPORT tags describing the latest state of sibling variants
+func (p *Publisher) renditionReports(b *bytes.Buffer) {
+	peers, _ := p.peers.Load().([]peer)
+	for _, peer := range peers {
+		state, ok := peer.pub.state.Load().(hlsState)
+		if !ok || state.playlist == nil {
+			continue
+		}
+		if state.parts != 0 {
+			fmt.Fprintf(b, "#EXT-X-RENDITION-REPORT:URI=\"%s\",LAST-MSN=%d,LAST-PART=%d\n", peer.uri, state.partMSN, state.parts-1)
+		} else {
+			fmt.Fprintf(b, "#EXT-X-RENDITION-REPORT:URI=\"%s\",LAST-MSN=%d\n", peer.uri, state.msn)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package hls
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of publisher statistics
+type Metrics struct {
+	// Segments is the total number of segments completed
+	Segments int64
+	// ShortSegments is the number of completed segments shorter than half the target duration
+	ShortSegments int64
+	// BytesWritten is the total size of all completed segments
+	BytesWritten int64
+	// ActiveSegments is the number of segments currently held, including precreated ones
+	ActiveSegments int64
+	// PlaylistDuration is the total duration of the segments in the playlist
+	PlaylistDuration time.Duration
+	// SinceKeyframe is the time elapsed since the last video keyframe was received, or zero if there hasn't been one
+	SinceKeyframe time.Duration
+	// CorrectedPackets is the number of packets whose timestamp went backwards and was adjusted to keep it monotonic
+	CorrectedPackets int64
+	// EvictedSegments is the number of segments removed early to stay within MaxDiskBytes
+	EvictedSegments int64
+	// DroppedPackets is the number of packets discarded while waiting for a keyframe to start a segment
+	DroppedPackets int64
+	// Discontinuities is the number of discontinuities inserted automatically because of timestamp jumps or MaxGap
+	Discontinuities int64
+	// QueueDepth is the number of writes waiting in the WriteQueue, and QueueDrops the number discarded because it was full
+	QueueDepth, QueueDrops int64
+	// BadKeyframes is the number of H.264 frames flagged as keyframes that weren't allowed to start a segment
+	// because they aren't IDR frames
+	BadKeyframes int64
+}
+
+// counters are updated by the writer and may be read concurrently
+type counters struct {
+	segments, short, bytes int64
+	active, playlistDur    int64
+	lastKey                int64
+	corrected              int64
+	evicted                int64
+	dropped                int64
+	autoDcn                int64
+	lastSeg                int64
+	queued, queueDrops     int64
+	pseudoKeys             int64
+	drift                  int64
+}
+
+// Metrics returns a snapshot of the publisher's statistics. It is safe to call concurrently with writing packets.
+func (p *Publisher) Metrics() Metrics {
+	m := Metrics{
+		Segments:         atomic.LoadInt64(&p.stats.segments),
+		ShortSegments:    atomic.LoadInt64(&p.stats.short),
+		BytesWritten:     atomic.LoadInt64(&p.stats.bytes),
+		ActiveSegments:   atomic.LoadInt64(&p.stats.active),
+		PlaylistDuration: time.Duration(atomic.LoadInt64(&p.stats.playlistDur)),
+		CorrectedPackets: atomic.LoadInt64(&p.stats.corrected),
+		EvictedSegments:  atomic.LoadInt64(&p.stats.evicted),
+		DroppedPackets:   atomic.LoadInt64(&p.stats.dropped),
+		Discontinuities:  atomic.LoadInt64(&p.stats.autoDcn),
+		QueueDepth:       atomic.LoadInt64(&p.stats.queued),
+		QueueDrops:       atomic.LoadInt64(&p.stats.queueDrops),
+		BadKeyframes:     atomic.LoadInt64(&p.stats.pseudoKeys),
+	}
+	if lastKey := atomic.LoadInt64(&p.stats.lastKey); lastKey != 0 {
+		m.SinceKeyframe = p.now().Sub(time.Unix(0, lastKey))
+	}
+	return m
+}
+
+// AVDrift returns how far the latest audio timestamp is ahead of the latest video timestamp, or behind if negative.
+// It is zero until both streams have had a packet since the start or the last discontinuity. A drift that keeps
+// growing indicates a sloppy source, and usually precedes playback problems.
+// It is safe to call concurrently with writing packets.
+func (p *Publisher) AVDrift() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.stats.drift))
+}
+
+// update the drift between the latest audio and video timestamps
+func (p *Publisher) measureDrift() {
+	if p.vidx < 0 || p.aidx < 0 {
+		return
+	}
+	var drift time.Duration
+	if v, a := p.lastTimes[p.vidx], p.lastTimes[p.aidx]; v != noTime && a != noTime {
+		drift = a - v
+	}
+	atomic.StoreInt64(&p.stats.drift, int64(drift))
+}
+
+// LastSegmentTime returns when the most recent segment started, or the zero time if none has.
+// It is safe to call concurrently with writing packets.
+func (p *Publisher) LastSegmentTime() time.Time {
+	if t := atomic.LoadInt64(&p.stats.lastSeg); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// update counters after a segment is completed
+func (c *counters) segmentDone(s *segment, targetDur time.Duration) {
+	atomic.AddInt64(&c.segments, 1)
+	atomic.AddInt64(&c.bytes, s.stored())
+	if s.dur < targetDur/2 {
+		atomic.AddInt64(&c.short, 1)
+	}
+}
+
+// Bitrate returns the average and peak bitrate in bits per second of the completed segments in the playlist.
+// Only segments since the most recent discontinuity are measured, and gaps are excluded.
+func (p *Publisher) Bitrate() (avg, peak int) {
+	state, _ := p.state.Load().(hlsState)
+	return state.avgBitrate, state.peakBitrate
+}
+
+// measure the bitrate of the completed segments since the last discontinuity
+func (p *Publisher) bitrate() (avg, peak int) {
+	var size int64
+	var dur time.Duration
+	for _, seg := range p.segments {
+		if seg.dcn {
+			size, dur, peak = 0, 0, 0
+		}
+		if !seg.final || seg.gap || seg.dur <= 0 {
+			continue
+		}
+		segSize := seg.stored()
+		size += segSize
+		dur += seg.dur
+		if br := int(float64(segSize*8) / seg.dur.Seconds()); br > peak {
+			peak = br
+		}
+	}
+	if dur > 0 {
+		avg = int(float64(size*8) / dur.Seconds())
+	}
+	return avg, peak
+}
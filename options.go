@@ -0,0 +1,124 @@
+package hls
+
+import (
+	"errors"
+	"path"
+	"time"
+)
+
+// Option configures a Publisher created by NewPublisher
+type Option func(*Publisher)
+
+// NewPublisher creates a publisher with the given options. Defaults are filled in explicitly, so the resulting fields
+// reflect the configuration actually in use.
+//
+// A Publisher can also be configured by setting its fields directly.
+func NewPublisher(opts ...Option) (*Publisher, error) {
+	p := new(Publisher)
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.BufferLength == 0 {
+		p.BufferLength = p.bufferLength()
+	}
+	if p.InitialDuration == 0 {
+		p.InitialDuration = 5 * time.Second
+	}
+	if p.Prefetch && p.Precreate == 0 {
+		// prefetch needs the next segment's name in advance
+		p.Precreate = 1
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks for configurations that can't work or would produce a broken playlist.
+// It is called by NewPublisher and WriteHeader.
+func (p *Publisher) Validate() error {
+	switch {
+	case p.InitialDuration < 0 || p.BufferLength < 0 || p.SegmentMaxAge < 0 || p.PartDuration < 0 ||
+		p.PSIInterval < 0 || p.MinSegmentDuration < 0 || p.MaxSegmentDuration < 0 || p.TargetSegmentDuration < 0:
+		return errors.New("durations must not be negative")
+	case p.Precreate < 0 || p.MinSegments < 0 || p.MaxSegments < 0 || p.PrimeSegments < 0 ||
+		p.DebugDiscontinuityEvery < 0:
+		return errors.New("segment counts must not be negative")
+	case p.InitialSequence < 0 || p.InitialDiscontinuitySequence < 0:
+		return errors.New("sequence numbers must not be negative")
+	case p.WriteQueue < 0:
+		return errors.New("WriteQueue must not be negative")
+	case p.DropOnFullQueue && p.WriteQueue == 0:
+		return errors.New("DropOnFullQueue requires WriteQueue")
+	case p.StaleAfter < 0:
+		return errors.New("StaleAfter must not be negative")
+	case p.Precreate > 0 && !p.Prefetch:
+		return errors.New("Precreate requires Prefetch, otherwise precreated segments are listed before they exist")
+	case p.BufferLength > 0 && (p.BufferLength < p.InitialDuration || p.BufferLength < p.MinSegmentDuration):
+		return errors.New("BufferLength is shorter than a single segment")
+	case p.MaxSegmentDuration > 0 && p.MinSegmentDuration > p.MaxSegmentDuration:
+		return errors.New("MinSegmentDuration is longer than MaxSegmentDuration")
+	case p.MaxSegmentDuration > 0 && p.InitialDuration > p.MaxSegmentDuration:
+		return errors.New("InitialDuration is longer than MaxSegmentDuration")
+	case p.TargetSegmentDuration > 0 && p.TargetSegmentDuration < p.MinSegmentDuration:
+		return errors.New("TargetSegmentDuration is shorter than MinSegmentDuration")
+	case p.MaxSegmentDuration > 0 && p.TargetSegmentDuration > p.MaxSegmentDuration:
+		return errors.New("TargetSegmentDuration is longer than MaxSegmentDuration")
+	case p.SplitLongGOPs && p.TargetSegmentDuration == 0:
+		return errors.New("SplitLongGOPs requires TargetSegmentDuration")
+	case p.MaxSegments > 0 && p.MinSegments > p.MaxSegments:
+		return errors.New("MinSegments is greater than MaxSegments")
+	case p.PartHoldBack < 0 || p.HoldBack < 0:
+		return errors.New("hold back must not be negative")
+	case p.PartHoldBack > 0 && p.PartHoldBack < 2*p.PartDuration:
+		return errors.New("PartHoldBack must be at least twice PartDuration")
+	case p.HoldBack > 0 && (p.HoldBack < 3*p.InitialDuration || p.HoldBack < 3*p.MinSegmentDuration):
+		return errors.New("HoldBack must be at least three target durations")
+	case p.PartByteRanges && p.PartDuration == 0:
+		return errors.New("PartByteRanges requires PartDuration")
+	case p.WallClockWeight < 0 || p.WallClockWeight > 1:
+		return errors.New("WallClockWeight must be between 0 and 1")
+	case p.PlaylistType != "" && p.PlaylistType != PlaylistEvent && p.PlaylistType != PlaylistVOD:
+		return errors.New("PlaylistType must be empty, EVENT or VOD")
+	case p.MasterFile != "" && (p.MasterFile == p.PlaylistName() || path.Ext(p.MasterFile) != ".m3u8"):
+		return errors.New("MasterFile must be a .m3u8 file name other than the media playlist's")
+	case p.Container != ContainerTS && p.Container != ContainerFMP4 && p.Container != ContainerPackedAudio:
+		return errors.New("unknown Container")
+	case p.TargetDurationStrategy != TargetMax && p.TargetDurationStrategy != TargetPercentile:
+		return errors.New("unknown TargetDurationStrategy")
+	case p.Loop && (p.PlaylistType != "" || p.Sink != nil):
+		return errors.New("Loop requires a live playlist that keeps its segments")
+	case p.Loop && p.Encryption != nil:
+		return errors.New("Loop can't replay encrypted segments")
+	case p.Encryption != nil && p.fmp4():
+		return errors.New("encryption is only supported with MPEG-TS segments")
+	case p.Encryption != nil && p.PartDuration > 0:
+		return errors.New("encryption can't be combined with partial segments")
+	}
+	return nil
+}
+
+// WithBufferLength sets the approximate duration spanned by the playlist
+func WithBufferLength(d time.Duration) Option {
+	return func(p *Publisher) { p.BufferLength = d }
+}
+
+// WithWorkDir stores segments in dir
+func WithWorkDir(dir string) Option {
+	return func(p *Publisher) { p.WorkDir = dir }
+}
+
+// WithPrefetch enables low-latency HLS (LHLS) prefetch tags
+func WithPrefetch(prefetch bool) Option {
+	return func(p *Publisher) { p.Prefetch = prefetch }
+}
+
+// WithPrecreate sets the number of segments created ahead of time
+func WithPrecreate(n int) Option {
+	return func(p *Publisher) { p.Precreate = n }
+}
+
+// WithInitialDuration sets the target duration assumed until the first segment is complete
+func WithInitialDuration(d time.Duration) Option {
+	return func(p *Publisher) { p.InitialDuration = d }
+}
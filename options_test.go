@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	key := &Encryption{Key: make([]byte, 16), KeyURI: "key"}
+	for _, tc := range []struct {
+		name string
+		p    *Publisher
+	}{
+		{"negative InitialDuration", &Publisher{InitialDuration: -time.Second}},
+		{"negative BufferLength", &Publisher{BufferLength: -time.Second}},
+		{"negative SegmentMaxAge", &Publisher{SegmentMaxAge: -time.Second}},
+		{"negative PartDuration", &Publisher{PartDuration: -time.Second}},
+		{"negative PSIInterval", &Publisher{PSIInterval: -time.Second}},
+		{"negative MinSegmentDuration", &Publisher{MinSegmentDuration: -time.Second}},
+		{"negative MaxSegmentDuration", &Publisher{MaxSegmentDuration: -time.Second}},
+		{"negative TargetSegmentDuration", &Publisher{TargetSegmentDuration: -time.Second}},
+		{"negative Precreate", &Publisher{Precreate: -1}},
+		{"negative MinSegments", &Publisher{MinSegments: -1}},
+		{"negative MaxSegments", &Publisher{MaxSegments: -1}},
+		{"negative PrimeSegments", &Publisher{PrimeSegments: -1}},
+		{"negative DebugDiscontinuityEvery", &Publisher{DebugDiscontinuityEvery: -1}},
+		{"negative InitialSequence", &Publisher{InitialSequence: -1}},
+		{"negative InitialDiscontinuitySequence", &Publisher{InitialDiscontinuitySequence: -1}},
+		{"negative WriteQueue", &Publisher{WriteQueue: -1}},
+		{"DropOnFullQueue without WriteQueue", &Publisher{DropOnFullQueue: true}},
+		{"negative StaleAfter", &Publisher{StaleAfter: -1}},
+		{"Precreate without Prefetch", &Publisher{Precreate: 2}},
+		{"BufferLength shorter than InitialDuration", &Publisher{BufferLength: time.Second, InitialDuration: 5 * time.Second}},
+		{"BufferLength shorter than MinSegmentDuration", &Publisher{BufferLength: time.Second, MinSegmentDuration: 2 * time.Second}},
+		{"MinSegmentDuration longer than MaxSegmentDuration", &Publisher{MinSegmentDuration: 5 * time.Second, MaxSegmentDuration: 2 * time.Second}},
+		{"InitialDuration longer than MaxSegmentDuration", &Publisher{InitialDuration: 5 * time.Second, MaxSegmentDuration: 2 * time.Second}},
+		{"TargetSegmentDuration shorter than MinSegmentDuration", &Publisher{TargetSegmentDuration: time.Second, MinSegmentDuration: 2 * time.Second}},
+		{"TargetSegmentDuration longer than MaxSegmentDuration", &Publisher{TargetSegmentDuration: 5 * time.Second, MaxSegmentDuration: 4 * time.Second, InitialDuration: time.Second}},
+		{"SplitLongGOPs without TargetSegmentDuration", &Publisher{SplitLongGOPs: true}},
+		{"MinSegments greater than MaxSegments", &Publisher{MinSegments: 10, MaxSegments: 5}},
+		{"negative PartHoldBack", &Publisher{PartHoldBack: -time.Second}},
+		{"negative HoldBack", &Publisher{HoldBack: -time.Second}},
+		{"PartHoldBack under twice PartDuration", &Publisher{PartDuration: time.Second, PartHoldBack: time.Second}},
+		{"HoldBack under three target durations", &Publisher{InitialDuration: 5 * time.Second, HoldBack: 10 * time.Second}},
+		{"PartByteRanges without PartDuration", &Publisher{PartByteRanges: true}},
+		{"negative WallClockWeight", &Publisher{WallClockWeight: -0.5}},
+		{"WallClockWeight over 1", &Publisher{WallClockWeight: 1.5}},
+		{"unknown PlaylistType", &Publisher{PlaylistType: "LIVE"}},
+		{"MasterFile same as playlist", &Publisher{MasterFile: "index.m3u8"}},
+		{"MasterFile not a playlist", &Publisher{MasterFile: "master.txt"}},
+		{"unknown Container", &Publisher{Container: Container(99)}},
+		{"unknown TargetDurationStrategy", &Publisher{TargetDurationStrategy: TargetStrategy(99)}},
+		{"Loop with an EVENT playlist", &Publisher{Loop: true, PlaylistType: PlaylistEvent}},
+		{"Loop with a Sink", &Publisher{Loop: true, Sink: func(SegmentInfo, io.Reader) error { return nil }}},
+		{"Loop with encryption", &Publisher{Loop: true, Encryption: key}},
+		{"encryption with fMP4", &Publisher{Container: ContainerFMP4, Encryption: key}},
+		{"encryption with partial segments", &Publisher{PartDuration: time.Second, Encryption: key}},
+	} {
+		if err := tc.p.Validate(); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestValidateAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    *Publisher
+	}{
+		{"defaults", &Publisher{}},
+		{"LL-HLS", &Publisher{PartDuration: 200 * time.Millisecond, PartByteRanges: true}},
+		{"prefetch", &Publisher{Prefetch: true, Precreate: 2}},
+		{"queue", &Publisher{WriteQueue: 16, DropOnFullQueue: true}},
+		{"target duration", &Publisher{TargetSegmentDuration: 4 * time.Second, SplitLongGOPs: true}},
+	} {
+		if err := tc.p.Validate(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
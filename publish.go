@@ -0,0 +1,44 @@
+package hls
+
+import (
+	"context"
+	"io"
+
+	"github.com/nareix/joy4/av"
+)
+
+// Publish writes the header, then every packet read from src until it returns io.EOF, and finally the trailer.
+// It returns the first error from reading or writing other than ErrNoKeyframe, or the context's error if ctx is
+// cancelled. Cancellation is checked between packets, so a source whose ReadPacket blocks must be unblocked by other
+// means, e.g. closing it. The trailer is written however Publish stops, so that the last segment is completed.
+func (p *Publisher) Publish(ctx context.Context, src av.PacketReader, streams []av.CodecData) error {
+	if err := p.WriteHeader(streams); err != nil {
+		return err
+	}
+	err := p.pump(ctx, src)
+	if terr := p.WriteTrailer(); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// copy packets from src until EOF
+func (p *Publisher) pump(ctx context.Context, src av.PacketReader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pkt, err := src.ReadPacket()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := p.WritePacket(pkt); err == ErrNoKeyframe {
+			// only a warning, and later packets are still accepted
+			p.logf("hls: %v", err)
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// PushSegment adds a segment that was muxed elsewhere to the playlist, for pipelines that don't pass packets through
+// the publisher. The data must be a complete segment in the format selected by Container; fMP4 segments additionally
+// depend on the init segment produced by WriteHeader. keyframe indicates that the segment starts with a keyframe
+// and can be decoded on its own.
+//
+// Pushed segments are numbered, trimmed and encrypted like any other, and follow on from the previous segment in
+// media time. PushSegment can't be used while a segment is being written from packets.
+func (p *Publisher) PushSegment(data []byte, dur time.Duration, keyframe bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pushSegment(bytes.NewReader(data), dur, keyframe)
+}
+
+// add a complete segment. Must be called with the lock held.
+func (p *Publisher) pushSegment(data io.Reader, dur time.Duration, keyframe bool) error {
+	if p.ended {
+		return ErrEnded
+	}
+	if p.current != nil {
+		return errors.New("a segment is being written from packets")
+	}
+	if dur <= 0 {
+		return errors.New("segment duration must be positive")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := p.start(); err != nil {
+		return err
+	}
+	if p.Encryption != nil && p.block == nil {
+		var err error
+		if p.block, err = p.Encryption.block(); err != nil {
+			return err
+		}
+	}
+	// precreated segments would be out of sequence
+	for _, seg := range p.presegs {
+		seg.Release()
+	}
+	p.presegs = nil
+	var prev *segment
+	if n := len(p.segments); n != 0 {
+		prev = p.segments[n-1]
+	}
+	seq := p.seq + int64(len(p.segments))
+	name, err := p.segmentName(seq)
+	if err != nil {
+		return err
+	}
+	seg := newSegment(name, p.segmentExt())
+	if err := seg.create(p.store()); err != nil {
+		return err
+	}
+	start := p.lastTime
+	seg.activate(seq, start, dur, p.dcn, keyframe, p.programTime(prev))
+	seg.init = p.initSeg
+	seg.wallStart = p.now()
+	atomic.StoreInt64(&p.stats.lastSeg, seg.wallStart.UnixNano())
+	p.markCue(seg)
+	p.logf("hls: pushed segment %s seq=%d at %s", seg.name, seq, start)
+	p.dcn = false
+	if err := p.pushData(seg, data); err != nil {
+		seg.Release()
+		return err
+	}
+	p.lastTime = start + dur
+	p.segments = append(p.segments, seg)
+	err = p.completeSegment(seg, p.lastTime)
+	p.targetDur = p.targetDuration()
+	p.trimSegments(p.targetDur)
+	p.publish()
+	// the pushed segment starts and completes at once
+	p.notify(seg, seg)
+	return err
+}
+
+// write the whole contents of a pushed segment, encrypting it if needed
+func (p *Publisher) pushData(seg *segment, data io.Reader) error {
+	if p.block == nil {
+		_, err := io.Copy(seg, data)
+		return err
+	}
+	enc := newCBCWriter(seg, p.block, p.Encryption.segmentIV(seg.seq))
+	if _, err := io.Copy(enc, data); err != nil {
+		return err
+	}
+	return enc.Close()
+}
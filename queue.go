@@ -0,0 +1,75 @@
+package hls
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// writeQueue stores segment data from a background goroutine, so that slow storage doesn't hold up muxing
+type writeQueue struct {
+	ch      chan queuedWrite
+	pending sync.WaitGroup
+	drop    bool
+	stats   *counters
+}
+
+type queuedWrite struct {
+	seg  *segment
+	data []byte
+}
+
+func newWriteQueue(n int, drop bool, stats *counters) *writeQueue {
+	q := &writeQueue{ch: make(chan queuedWrite, n), drop: drop, stats: stats}
+	go q.run()
+	return q
+}
+
+func (q *writeQueue) run() {
+	for w := range q.ch {
+		w.seg.store(w.data)
+		atomic.AddInt64(&q.stats.queued, -1)
+		q.pending.Done()
+	}
+}
+
+// queue data to be stored, returning false if it was dropped because the queue is full
+func (q *writeQueue) push(seg *segment, data []byte) bool {
+	q.pending.Add(1)
+	atomic.AddInt64(&q.stats.queued, 1)
+	w := queuedWrite{seg: seg, data: data}
+	if !q.drop {
+		q.ch <- w
+		return true
+	}
+	select {
+	case q.ch <- w:
+		return true
+	default:
+		atomic.AddInt64(&q.stats.queued, -1)
+		atomic.AddInt64(&q.stats.queueDrops, 1)
+		q.pending.Done()
+		return false
+	}
+}
+
+// wait until everything queued so far has been stored
+func (q *writeQueue) wait() {
+	q.pending.Wait()
+}
+
+// stop the worker once the queue drains
+func (q *writeQueue) close() {
+	close(q.ch)
+}
+
+// wait for the current segment's data to be stored, returning any error storing it
+func (p *Publisher) drain() error {
+	if p.queue == nil {
+		return nil
+	}
+	p.queue.wait()
+	s := p.current
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.werr
+}
@@ -0,0 +1,110 @@
+package hls
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+// meant to be run with -race: packets are written while settings change and clients read
+func TestConcurrentWriteAndServe(t *testing.T) {
+	p := &Publisher{InMemory: true, Prefetch: true, BufferLength: 10 * time.Second}
+	defer p.Close()
+	src := hlstest.Source{KeyframeInterval: time.Second, Duration: 30 * time.Second}
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		// operator changing settings
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			p.SetBufferLength(time.Duration(5+i%10) * time.Second)
+			p.SetPrecreate(i % 3)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		go func() {
+			// clients polling the playlist and fetching the newest segment
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				rw := httptest.NewRecorder()
+				p.ServeHTTP(rw, httptest.NewRequest("GET", "/index.m3u8", nil))
+				if segs := p.Segments(); len(segs) > 1 {
+					rw := httptest.NewRecorder()
+					p.ServeHTTP(rw, httptest.NewRequest("GET", "/"+segs[len(segs)-2].Name, nil))
+					ioutil.ReadAll(rw.Body)
+				}
+				p.Metrics()
+				p.Healthy()
+			}
+		}()
+	}
+	for _, pkt := range src.Packets() {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	if err := p.WriteTrailer(); err != nil {
+		t.Error(err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// meant to be run with -race: MaxDiskBytes sizes up segments while the WriteQueue is still storing them
+func TestQueuedWritesWithDiskLimit(t *testing.T) {
+	p := &Publisher{InMemory: true, WriteQueue: 64, MaxDiskBytes: 500 << 10, InitialDuration: time.Second}
+	defer p.Close()
+	src := hlstest.Source{KeyframeInterval: time.Second, Duration: 30 * time.Second}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			rw := httptest.NewRecorder()
+			p.ServeHTTP(rw, httptest.NewRequest("GET", "/index.m3u8", nil))
+			if segs := p.Segments(); len(segs) != 0 {
+				rw := httptest.NewRecorder()
+				p.ServeHTTP(rw, httptest.NewRequest("GET", "/"+segs[len(segs)-1].Name, nil))
+			}
+			p.Metrics()
+		}
+	}()
+	err := src.WriteAll(p)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := p.Metrics(); m.EvictedSegments == 0 {
+		t.Error("expected MaxDiskBytes to evict segments")
+	}
+}
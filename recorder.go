@@ -0,0 +1,158 @@
+package hls
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4"
+)
+
+// Recorder writes a continuous MP4 recording of a stream, optionally rotating to a new file periodically.
+//
+// Recorder can be used on its own as an av.Muxer, or attached to Publisher.Recorder to record alongside the live stream.
+// When attached, recording errors never interrupt live delivery; instead recording stops and the error is reported by Err.
+type Recorder struct {
+	// Path is the file to record to, used as is
+	Path string
+	// PathLayout, if set, is used instead of Path and formatted with time.Time.Format using the time each file is
+	// opened, e.g. "recording-20060102-150405.mp4"
+	PathLayout string
+	// RotateInterval, if set, starts a new file at the first keyframe after this much time has been recorded
+	RotateInterval time.Duration
+	// Now is used to format PathLayout. Defaults to time.Now.
+	Now func() time.Time
+
+	streams []av.CodecData
+	vidx    int
+	f       *os.File
+	mux     *mp4.Muxer
+	start   time.Duration
+
+	mu  sync.Mutex
+	err error
+}
+
+// WriteHeader sets the streams to be recorded. Recording begins at the first keyframe.
+func (r *Recorder) WriteHeader(streams []av.CodecData) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	r.streams = streams
+	r.vidx = -1
+	for i, cd := range streams {
+		if cd.Type().IsVideo() {
+			r.vidx = i
+		}
+	}
+	return nil
+}
+
+// WritePacket records a single packet
+func (r *Recorder) WritePacket(pkt av.Packet) error {
+	if r.streams == nil {
+		return errors.New("recorder header is not set")
+	}
+	isKey := r.vidx < 0 || (int(pkt.Idx) == r.vidx && pkt.IsKeyFrame)
+	if isKey && r.mux != nil && r.RotateInterval > 0 && pkt.Time-r.start >= r.RotateInterval {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.mux == nil {
+		if !isKey {
+			// waiting for first keyframe
+			return nil
+		}
+		if err := r.openFile(pkt.Time); err != nil {
+			return err
+		}
+	}
+	pkt.Time -= r.start
+	return r.mux.WritePacket(pkt)
+}
+
+// WriteTrailer finalizes the current recording
+func (r *Recorder) WriteTrailer() error {
+	return r.closeFile()
+}
+
+// Err returns the error that stopped an attached recorder, if any
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) openFile(start time.Duration) error {
+	now := time.Now
+	if r.Now != nil {
+		now = r.Now
+	}
+	name := r.Path
+	if r.PathLayout != "" {
+		name = now().Format(r.PathLayout)
+	}
+	f, err := createUnique(name)
+	if err != nil {
+		return err
+	}
+	mux := mp4.NewMuxer(f)
+	if err := mux.WriteHeader(r.streams); err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.mux = mux
+	r.start = start
+	return nil
+}
+
+// create a new file, adding a numeric suffix before the extension if the name is taken, so that rotating or
+// restarting never overwrites an earlier recording
+func createUnique(name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = base + "-" + strconv.Itoa(i) + ext
+		}
+		f, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// write the moov atom and close the current file
+func (r *Recorder) closeFile() error {
+	if r.mux == nil {
+		return nil
+	}
+	err := r.mux.WriteTrailer()
+	if err2 := r.f.Close(); err == nil {
+		err = err2
+	}
+	r.f = nil
+	r.mux = nil
+	return err
+}
+
+// run a recording step on behalf of a publisher, stopping the recording on failure
+func (r *Recorder) tap(f func() error) {
+	if r.Err() != nil {
+		return
+	}
+	if err := f(); err != nil {
+		r.closeFile()
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+}
@@ -1,12 +1,13 @@
 package hls
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,44 +19,123 @@ type segment struct {
 	cond   sync.Cond
 	chunks [][]byte
 	views  uintptr
+	// readers using the contents, which are only freed once released and unused
+	refs     int
+	released bool
+	// error from a queued write
+	werr error
 	// fixed at creation
+	seq   int64
 	start time.Duration
 	name  string
 	mime  string
 	dcn   bool
-	ptime string
+	indep bool
+	ptime time.Time
+	init  *initSegment
+	// writer only
+	frames    int
+	partStart time.Duration
+	partIndep bool
+	hdrLen    int64
+	iframes   []iframe
+	gap       bool
+	kbps      int
+	written   int64
+	queue     *writeQueue
+	dropped   bool
+	wallStart time.Time
+	cue       string
+	// completed partial segments
+	parts []part
 	// finalized
-	f     *os.File
+	buf   SegmentFile
 	final bool
 	size  int64
 	dur   time.Duration
 }
 
-// create a new live segment
-func newSegment(segNum int64, workDir string, fmp4 bool) (*segment, error) {
-	s := &segment{name: strconv.FormatInt(segNum, 36)}
-	if fmp4 {
-		s.name += ".m4s"
-		s.mime = "video/iso.segment"
-	} else {
-		s.name += ".ts"
-		s.mime = "video/MP2T"
-	}
+// a partial segment, as a byte range of its parent
+type part struct {
+	offset, size int64
+	dur          time.Duration
+	independent  bool
+}
+
+// create a new live segment, without storage
+func newSegment(name, ext string) *segment {
+	s := &segment{name: name + ext}
+	s.mime = mimeType(s.name)
 	s.cond.L = &s.mu
-	var err error
-	s.f, err = ioutil.TempFile(workDir, s.name)
+	return s
+}
+
+// allocate storage for the segment's contents
+func (s *segment) create(store SegmentStore) error {
+	buf, err := store.Create(s.name)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	s.mu.Lock()
+	s.buf = buf
+	s.mu.Unlock()
+	return nil
+}
+
+// content type for a file served by the publisher, based on its extension
+func mimeType(name string) string {
+	switch path.Ext(name) {
+	case ".ts":
+		return "video/MP2T"
+	case ".m4s", ".mp4":
+		// widely accepted, unlike video/iso.segment
+		return "video/mp4"
+	case ".aac":
+		return "audio/aac"
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".vtt":
+		return "text/vtt"
 	}
-	os.Remove(s.f.Name())
-	return s, nil
+	return "application/octet-stream"
 }
 
-func (s *segment) activate(start, initialDur time.Duration, dcn bool, programTime string) {
+func (s *segment) activate(seq int64, start, initialDur time.Duration, dcn, independent bool, programTime time.Time) {
+	s.seq = seq
 	s.start = start
 	s.dur = initialDur
 	s.dcn = dcn
+	s.indep = independent
 	s.ptime = programTime
+	s.partStart = start
+	s.partIndep = independent
+}
+
+// complete the current partial segment
+func (s *segment) endPart(end time.Duration, nextIndependent bool) {
+	s.mu.Lock()
+	var offset int64
+	if n := len(s.parts); n != 0 {
+		offset = s.parts[n-1].offset + s.parts[n-1].size
+	}
+	if s.size > offset {
+		s.parts = append(s.parts, part{
+			offset:      offset,
+			size:        s.size - offset,
+			dur:         end - s.partStart,
+			independent: s.partIndep,
+		})
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	s.partStart = end
+	s.partIndep = nextIndependent
+}
+
+// URI of a partial segment
+func (s *segment) partName(i int) string {
+	ext := path.Ext(s.name)
+	return s.name[:len(s.name)-len(ext)] + "." + strconv.Itoa(i) + ext
 }
 
 // add bytes to the end of a live segment
@@ -65,48 +145,137 @@ func (s *segment) Write(d []byte) (int, error) {
 	}
 	buf := make([]byte, len(d))
 	copy(buf, d)
+	s.written += int64(len(d))
+	if s.queue == nil {
+		return len(d), s.store(buf)
+	}
+	if !s.dropped && !s.queue.push(s, buf) {
+		// a hole would corrupt the rest of the segment, so stop storing it
+		s.dropped = true
+	}
+	return len(d), nil
+}
+
+// store bytes and make them available to readers
+func (s *segment) store(buf []byte) error {
+	// store first so that readers can fetch any range up to the size
+	if _, err := s.buf.Write(buf); err != nil {
+		s.mu.Lock()
+		if s.werr == nil {
+			s.werr = err
+		}
+		s.mu.Unlock()
+		return err
+	}
 
 	s.mu.Lock()
 	s.chunks = append(s.chunks, buf)
 	s.size += int64(len(buf))
 	s.mu.Unlock()
 	s.cond.Broadcast()
-	return s.f.Write(d)
+	return nil
+}
+
+// number of bytes stored so far, which a WriteQueue updates in the background
+func (s *segment) stored() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
 }
 
 // finalize a live segment
-func (s *segment) Finalize(nextSegment time.Duration) {
+func (s *segment) Finalize(nextSegment time.Duration) error {
+	err := s.buf.Finalize()
+	s.mu.Lock()
 	// in case of stream restart, timestamps can go backwards, so just stick to the estimate
 	if nextSegment > s.start {
 		s.dur = nextSegment - s.start
 	}
-	s.mu.Lock()
 	s.final = true
 	s.chunks = nil
 	s.mu.Unlock()
 	s.cond.Broadcast()
+	return err
 }
 
-// free resources associated with the segment
+// free resources associated with the segment, once any clients still reading it are done
 func (s *segment) Release() {
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return
+	}
+	s.released = true
+	unused := s.refs == 0
+	s.mu.Unlock()
+	// wake readers waiting for data that now won't arrive
+	s.cond.Broadcast()
+	if unused {
+		s.free()
+	}
+}
+
+// take a reference to the contents for a reader, unless the segment has been released
+func (s *segment) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return false
+	}
+	s.refs++
+	return true
+}
+
+// drop a reader's reference, freeing the contents if it was the last one after release
+func (s *segment) unref() {
+	s.mu.Lock()
+	s.refs--
+	unused := s.released && s.refs == 0
+	s.mu.Unlock()
+	if unused {
+		s.free()
+	}
+}
+
+func (s *segment) free() {
 	s.mu.Lock()
 	s.size = 0
-	s.f.Close()
-	s.f = nil
+	if s.buf != nil {
+		s.buf.Release()
+		s.buf = nil
+	}
 	s.mu.Unlock()
 }
 
 // m3u8 fragment for this segment
-func (s *segment) Format(prefetch bool) string {
+func (s *segment) Format(prefetch, withParts, byteRanges bool) string {
 	var formatted, pf string
-	if s.final || !prefetch {
-		formatted = fmt.Sprintf("#EXTINF:%.03f,live\n%s\n", s.dur.Seconds(), s.name)
+	if withParts {
+		var b strings.Builder
+		for i, pt := range s.parts {
+			if byteRanges {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%s,URI=\"%s\",BYTERANGE=\"%d@%d\"", formatSeconds(pt.dur), s.name, pt.size, pt.offset)
+			} else {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%s,URI=\"%s\"", formatSeconds(pt.dur), s.partName(i))
+			}
+			if pt.independent {
+				b.WriteString(",INDEPENDENT=YES")
+			}
+			b.WriteString("\n")
+		}
+		if s.final {
+			b.WriteString(s.extinf())
+		}
+		formatted = b.String()
+	} else if s.final || !prefetch {
+		formatted = s.extinf()
 	} else {
 		formatted = fmt.Sprintf("#EXT-X-PREFETCH:%s\n", s.name)
 		pf = "-PREFETCH"
 	}
-	if s.ptime != "" {
-		formatted = "#EXT-X" + pf + "-PROGRAM-DATE-TIME:" + s.ptime + "\n" + formatted
+	formatted = s.cue + formatted
+	if !s.ptime.IsZero() {
+		formatted = "#EXT-X" + pf + "-PROGRAM-DATE-TIME:" + s.ptime.UTC().Format("2006-01-02T15:04:05.999Z07:00") + "\n" + formatted
 	}
 	if s.dcn {
 		formatted = "#EXT-X" + pf + "-DISCONTINUITY\n" + formatted
@@ -114,55 +283,303 @@ func (s *segment) Format(prefetch bool) string {
 	return formatted
 }
 
+// add headers identifying the segment, or one of its parts if part >= 0
+func (s *segment) setHeaders(h http.Header, part int) {
+	// the sequence number is fixed once the segment is listed
+	h.Set("X-Media-Sequence", strconv.FormatInt(s.seq, 10))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case part >= 0:
+		h.Set("X-Part-Index", strconv.Itoa(part))
+		if part < len(s.parts) {
+			h.Set("X-Part-Duration", formatSeconds(s.parts[part].dur))
+		}
+	case s.final:
+		h.Set("X-Segment-Duration", formatSeconds(s.dur))
+	}
+}
+
+// decimal seconds with millisecond precision, as used for all durations in playlists
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// m3u8 tags for the complete segment
+func (s *segment) extinf() string {
+	formatted := "#EXTINF:" + formatSeconds(s.dur) + ",live\n" + s.name + "\n"
+	if s.kbps != 0 {
+		formatted = "#EXT-X-BITRATE:" + strconv.Itoa(s.kbps) + "\n" + formatted
+	}
+	if s.gap {
+		formatted = "#EXT-X-GAP\n" + formatted
+	}
+	return formatted
+}
+
+// wake waiting readers when the context is cancelled, until the returned function is called
+func (s *segment) wakeOnCancel(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// parse a Range header holding a single closed byte range
+func parseRange(header string) (start, end int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.ContainsRune(header, ',') {
+		return 0, 0, false
+	}
+	i := strings.IndexByte(header, '-')
+	if i < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(header[6:i], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err = strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// serve a byte range of a live segment once it has been written. Called with the lock held, which is released.
+func (s *segment) serveLiveRange(ctx context.Context, rw http.ResponseWriter, start, end int64) {
+	for !s.final && s.size <= end && !s.released {
+		if ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.cond.Wait()
+	}
+	if s.buf == nil || (!s.final && s.size <= end) {
+		s.mu.Unlock()
+		http.Error(rw, "segment has been released", http.StatusNotFound)
+		return
+	}
+	buf, size, final := s.buf, s.size, s.final
+	s.mu.Unlock()
+	if final && end >= size {
+		end = size - 1
+	}
+	if start > end {
+		http.Error(rw, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	total := "*"
+	if final {
+		total = strconv.FormatInt(size, 10)
+	}
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, total))
+	rw.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	rw.WriteHeader(http.StatusPartialContent)
+	io.Copy(rw, io.NewSectionReader(buf, start, end-start+1))
+}
+
+// serve a completed partial segment to a client
+func (s *segment) servePart(rw http.ResponseWriter, req *http.Request, i int, lookahead bool) {
+	if !s.acquire() {
+		http.NotFound(rw, req)
+		return
+	}
+	defer s.unref()
+	s.mu.Lock()
+	if lookahead && i <= len(s.parts) && !s.final && s.buf != nil {
+		defer s.wakeOnCancel(req.Context())()
+		s.streamParts(req.Context(), rw, i)
+		return
+	}
+	if i == len(s.parts) && !s.final && s.buf != nil {
+		// the part in progress, as advertised by a preload hint
+		defer s.wakeOnCancel(req.Context())()
+		s.streamPart(req.Context(), rw, i)
+		return
+	}
+	if i >= len(s.parts) || s.buf == nil {
+		s.mu.Unlock()
+		http.NotFound(rw, req)
+		return
+	}
+	pt := s.parts[i]
+	r := io.NewSectionReader(s.buf, pt.offset, pt.size)
+	s.mu.Unlock()
+	rw.Header().Set("Content-Type", s.mime)
+	rw.Header().Set("Content-Length", strconv.FormatInt(pt.size, 10))
+	io.Copy(rw, r)
+}
+
+// stream a part as it is written. Called with the lock held, which is released.
+func (s *segment) streamPart(ctx context.Context, rw http.ResponseWriter, i int) {
+	rw.Header().Set("Content-Type", s.mime)
+	flusher, _ := rw.(http.Flusher)
+	var pos int64
+	if i > 0 {
+		pos = s.parts[i-1].offset + s.parts[i-1].size
+	}
+	for {
+		end := s.size
+		done := len(s.parts) > i
+		if done {
+			end = s.parts[i].offset + s.parts[i].size
+		} else if s.final {
+			// the part was empty
+			s.mu.Unlock()
+			return
+		}
+		if end > pos && s.buf != nil {
+			r := io.NewSectionReader(s.buf, pos, end-pos)
+			s.mu.Unlock()
+			n, err := io.Copy(rw, r)
+			if err != nil {
+				return
+			}
+			pos += n
+			if flusher != nil {
+				flusher.Flush()
+			}
+			s.mu.Lock()
+			continue
+		}
+		if done || s.released || ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.cond.Wait()
+	}
+}
+
+// stream from the start of part i to the end of the segment, flushing as each part completes.
+// Called with the lock held, which is released.
+func (s *segment) streamParts(ctx context.Context, rw http.ResponseWriter, i int) {
+	rw.Header().Set("Content-Type", s.mime)
+	flusher, _ := rw.(http.Flusher)
+	var pos int64
+	if i > 0 {
+		pos = s.parts[i-1].offset + s.parts[i-1].size
+	}
+	for {
+		var end int64
+		if s.final {
+			end = s.size
+		} else if n := len(s.parts); n != 0 {
+			end = s.parts[n-1].offset + s.parts[n-1].size
+		}
+		if end > pos && s.buf != nil {
+			r := io.NewSectionReader(s.buf, pos, end-pos)
+			s.mu.Unlock()
+			n, err := io.Copy(rw, r)
+			if err != nil {
+				return
+			}
+			pos += n
+			if flusher != nil {
+				flusher.Flush()
+			}
+			s.mu.Lock()
+			continue
+		}
+		if s.final || s.released || ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.cond.Wait()
+	}
+}
+
 // serve the segment to a client
 func (s *segment) serveHTTP(rw http.ResponseWriter, req *http.Request) {
-	rw.Header().Set("Cache-Control", "max-age=600, public")
+	if !s.acquire() {
+		http.NotFound(rw, req)
+		return
+	}
+	defer s.unref()
 	rw.Header().Set("Content-Type", s.mime)
 	flusher, _ := rw.(http.Flusher)
 	atomic.AddUintptr(&s.views, 1)
+	ctx := req.Context()
 	s.mu.Lock()
-	var copied int64
-	if s.final {
-		// already finalized
-		// setting content-length avoids chunked transfer-encoding
-		rw.Header().Set("Content-Length", strconv.FormatInt(s.size, 10))
-	} else {
-		// live streaming
-		var pos int
-		var needFlush bool
-		for {
-			if pos == len(s.chunks) && needFlush && flusher != nil {
-				// if there's nothing better to do, then flush the current buffer out and try again
-				s.mu.Unlock()
-				flusher.Flush()
-				needFlush = false
-				s.mu.Lock()
-				continue
-			}
-			for ; pos < len(s.chunks); pos++ {
-				d := s.chunks[pos]
+	if !s.final {
+		defer s.wakeOnCancel(ctx)()
+	}
+	if !s.final && req.Method != http.MethodHead {
+		if start, end, ok := parseRange(req.Header.Get("Range")); ok {
+			s.serveLiveRange(ctx, rw, start, end)
+			return
+		}
+	}
+	if !s.final && (req.Method == http.MethodHead || req.Header.Get("Range") != "") {
+		// ranges and the length aren't known until the segment is complete
+		for !s.final {
+			if ctx.Err() != nil || s.released {
 				s.mu.Unlock()
-				if _, err := rw.Write(d); err != nil {
-					return
-				}
-				copied += int64(len(d))
-				needFlush = true
-				s.mu.Lock()
-			}
-			if s.final {
-				break
+				return
 			}
 			s.cond.Wait()
 		}
 	}
+	if s.final {
+		// already finalized
+		if s.buf == nil {
+			s.mu.Unlock()
+			http.NotFound(rw, req)
+			return
+		}
+		r := io.NewSectionReader(s.buf, 0, s.size)
+		s.mu.Unlock()
+		// handles ranges, and setting content-length avoids chunked transfer-encoding
+		http.ServeContent(rw, req, "", time.Time{}, r)
+		return
+	}
+	// live streaming
+	var copied int64
+	var pos int
+	var needFlush bool
+	for {
+		if pos == len(s.chunks) && needFlush && flusher != nil {
+			// if there's nothing better to do, then flush the current buffer out and try again
+			s.mu.Unlock()
+			flusher.Flush()
+			needFlush = false
+			s.mu.Lock()
+			continue
+		}
+		for ; pos < len(s.chunks); pos++ {
+			d := s.chunks[pos]
+			s.mu.Unlock()
+			if _, err := rw.Write(d); err != nil {
+				return
+			}
+			copied += int64(len(d))
+			needFlush = true
+			s.mu.Lock()
+		}
+		if s.final {
+			break
+		}
+		if ctx.Err() != nil || s.released {
+			// client went away, or the segment was abandoned
+			s.mu.Unlock()
+			return
+		}
+		s.cond.Wait()
+	}
 	remainder := s.size - copied
-	if remainder <= 0 || s.f == nil {
+	if remainder <= 0 || s.buf == nil {
 		// complete
 		s.mu.Unlock()
 		return
 	}
 	// serve the remainder from file
-	r := io.NewSectionReader(s.f, copied, remainder)
+	r := io.NewSectionReader(s.buf, copied, remainder)
 	s.mu.Unlock()
 	io.Copy(rw, r)
 }
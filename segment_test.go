@@ -0,0 +1,28 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFractionalEXTINF(t *testing.T) {
+	for _, tc := range []struct {
+		dur  time.Duration
+		want string
+	}{
+		{2002 * time.Millisecond, "#EXTINF:2.002,"},
+		{866700 * time.Microsecond, "#EXTINF:0.867,"},
+		{5983 * time.Millisecond, "#EXTINF:5.983,"},
+		// 60 frames at 29.97 fps
+		{60 * 1001 * time.Second / 30000, "#EXTINF:2.002,"},
+		{4 * time.Second, "#EXTINF:4.000,"},
+	} {
+		s := newSegment("seg", ".ts")
+		s.dur = tc.dur
+		s.final = true
+		if got := s.Format(false, false, false); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%v: got %q, expected %s", tc.dur, got, tc.want)
+		}
+	}
+}
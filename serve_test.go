@@ -0,0 +1,178 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+// publisher with a few complete segments, for exercising the HTTP handlers
+func servingPublisher(t *testing.T) *Publisher {
+	t.Helper()
+	p := &Publisher{InMemory: true}
+	if err := (hlstest.Source{Duration: 10 * time.Second}).WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServeTraversal(t *testing.T) {
+	p := servingPublisher(t)
+	defer p.Close()
+	for _, target := range []string{
+		"/../../etc/passwd",
+		"/%2e%2e/%2e%2e/etc/passwd",
+		"/..%2f..%2fetc%2fpasswd",
+		"/etc/passwd",
+		"//etc/passwd",
+		"/%2fetc%2fpasswd",
+		"/index.m3u8%00.ts",
+		"/..",
+		"/%2e%2e",
+		"/" + p.Segments()[0].Name + "/../../../etc/passwd",
+	} {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest("GET", target, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, expected 404", target, rw.Code)
+		}
+		if strings.Contains(rw.Body.String(), "root:") {
+			t.Errorf("%s: served a file from outside the playlist", target)
+		}
+	}
+	// sanity check that listed segments are served
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/"+p.Segments()[0].Name, nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("listed segment got status %d", rw.Code)
+	}
+}
+
+func TestOpenSegmentTraversal(t *testing.T) {
+	p := servingPublisher(t)
+	defer p.Close()
+	for _, name := range []string{
+		"",
+		"..",
+		"../etc/passwd",
+		"/etc/passwd",
+		"%2e%2e/etc/passwd",
+		"../" + p.Segments()[0].Name,
+		p.Segments()[0].Name + "\x00",
+	} {
+		if r, err := p.OpenSegment(name); err == nil {
+			r.Close()
+			t.Errorf("%q: opened a segment that isn't in the playlist", name)
+		}
+	}
+}
+
+func TestServeKeyUncached(t *testing.T) {
+	p := &Publisher{InMemory: true, Encryption: &Encryption{Key: make([]byte, 16), KeyURI: "stream.key", KeyName: "stream.key"}}
+	defer p.Close()
+	if err := (hlstest.Source{Duration: 4 * time.Second}).WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/stream.key", nil))
+	if rw.Code != http.StatusOK || rw.Body.Len() != 16 {
+		t.Fatalf("got status %d with %d bytes", rw.Code, rw.Body.Len())
+	}
+	if cc := rw.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("key served with Cache-Control %q", cc)
+	}
+}
+
+func TestPlaylistHeaders(t *testing.T) {
+	p := &Publisher{InMemory: true, AllowCORS: true, PlaylistContentType: "audio/mpegurl"}
+	defer p.Close()
+	if err := (hlstest.Source{Duration: 10 * time.Second}).WriteAll(p); err != nil {
+		t.Fatal(err)
+	}
+	m := new(MasterPlaylist)
+	m.AddVariant(Variant{Name: "video", Publisher: p})
+	subs := &SubtitlePublisher{Video: p}
+	for _, tc := range []struct {
+		name string
+		h    http.Handler
+	}{
+		{"multivariant", m},
+		{"media", p},
+		{"subtitles", subs},
+	} {
+		req := httptest.NewRequest("GET", "/index.m3u8", nil)
+		req.Header.Set("Origin", "https://player.example")
+		rw := httptest.NewRecorder()
+		tc.h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", tc.name, rw.Code)
+			continue
+		}
+		if origin := rw.Header().Get("Access-Control-Allow-Origin"); origin != "https://player.example" {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q", tc.name, origin)
+		}
+		if ct := rw.Header().Get("Content-Type"); ct != "audio/mpegurl" {
+			t.Errorf("%s: got Content-Type %q", tc.name, ct)
+		}
+		if cc := rw.Header().Get("Cache-Control"); cc != "no-cache" {
+			t.Errorf("%s: got Cache-Control %q", tc.name, cc)
+		}
+	}
+}
+
+func TestMultivariantBeforeMeasured(t *testing.T) {
+	p := &Publisher{InMemory: true, MasterFile: "master.m3u8"}
+	defer p.Close()
+	src := hlstest.Source{}
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	// start the first segment without completing it
+	for _, pkt := range src.Packets()[:10] {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := new(MasterPlaylist)
+	m.AddVariant(Variant{Name: "video", Publisher: p})
+	for _, tc := range []struct {
+		name, target string
+		h            http.Handler
+	}{
+		{"MasterPlaylist", "/index.m3u8", m},
+		{"MasterFile", "/master.m3u8", p},
+	} {
+		rw := httptest.NewRecorder()
+		tc.h.ServeHTTP(rw, httptest.NewRequest("GET", tc.target, nil))
+		if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: got status %d with Retry-After %q, expected 503 asking to retry", tc.name, rw.Code, rw.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestBlockingReloadBadRequest(t *testing.T) {
+	p := servingPublisher(t)
+	defer p.Close()
+	for _, query := range []string{
+		"_HLS_msn=abc",
+		"_HLS_msn=-1",
+		"_HLS_msn=1&_HLS_part=abc",
+		"_HLS_msn=1&_HLS_part=-1",
+		"_HLS_part=1",
+		"_HLS_msn=1000",
+	} {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest("GET", "/index.m3u8?"+query, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, expected 400", query, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package hls
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SegmentStore is a storage backend for segment contents
+type SegmentStore interface {
+	// Create returns a new, empty file for the segment with the given name
+	Create(name string) (SegmentFile, error)
+}
+
+// SegmentFile holds the contents of a single segment.
+//
+// Write and Finalize are called from the goroutine writing packets, while ReadAt may be called concurrently to serve clients.
+type SegmentFile interface {
+	io.Writer
+	io.ReaderAt
+	// Finalize is called once the segment is complete and no more writes will follow
+	Finalize() error
+	// Release is called once the segment has been removed from the playlist and its contents are no longer needed
+	Release() error
+}
+
+// DiskStore keeps segments in anonymous temporary files
+type DiskStore struct {
+	// Dir is where files are created. If empty, the default system temp dir is used.
+	Dir string
+	// Prefix is prepended to the name of every file created, followed by a dash, identifying them to Cleanup.
+	// Stores sharing a Dir need distinct prefixes, and one shouldn't be another followed by a dash.
+	Prefix string
+}
+
+// ending of every file a DiskStore creates, after a random number, so that Cleanup can recognize them
+const tempSuffix = ".hls-segment"
+
+// start of every file name, keeping the prefix apart from the segment name so that prefixes sharing a start, such
+// as "cam" and "camera", don't match each other's files
+func (d DiskStore) stem() string {
+	if d.Prefix == "" {
+		return ""
+	}
+	return d.Prefix + "-"
+}
+
+// Create a temporary file that is deleted once released
+func (d DiskStore) Create(name string) (SegmentFile, error) {
+	f, err := ioutil.TempFile(d.Dir, d.stem()+name+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return diskFile{f}, nil
+}
+
+// check that files can be created in Dir
+func (d DiskStore) probe() error {
+	f, err := ioutil.TempFile(d.Dir, d.stem()+"probe.*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Cleanup removes files left in Dir by an earlier store with the same Prefix, e.g. after a crash. Only names
+// following the store's own scheme are matched, so other files starting with Prefix are left alone.
+// Files are normally unlinked as soon as they are created, so only an unclean exit can leave them behind.
+// It must not be called while another store with the same Dir and Prefix is in use.
+func (d DiskStore) Cleanup() error {
+	if d.Prefix == "" {
+		return errors.New("a prefix is required to identify files to clean up")
+	}
+	dir := d.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && d.owns(fi.Name()) {
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check if a file name is one Create would have produced: the prefix and a dash, a segment name, a dot and a random
+// number, then tempSuffix
+func (d DiskStore) owns(name string) bool {
+	stem := d.stem()
+	rest := strings.TrimSuffix(name, tempSuffix)
+	if rest == name || !strings.HasPrefix(rest, stem) {
+		return false
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i <= len(stem) {
+		return false
+	}
+	_, err := strconv.ParseUint(rest[i+1:], 10, 64)
+	return err == nil
+}
+
+type diskFile struct {
+	*os.File
+}
+
+func (f diskFile) Finalize() error {
+	return nil
+}
+
+func (f diskFile) Release() error {
+	return f.Close()
+}
+
+// MemoryStore keeps segments in RAM
+type MemoryStore struct{}
+
+// Create an empty in-memory segment
+func (MemoryStore) Create(name string) (SegmentFile, error) {
+	return new(memFile), nil
+}
+
+type memFile struct {
+	mu       sync.RWMutex
+	b        []byte
+	released bool
+}
+
+func (m *memFile) Write(d []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.released {
+		return 0, os.ErrClosed
+	}
+	m.b = append(m.b, d...)
+	return len(d), nil
+}
+
+func (m *memFile) ReadAt(d []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.released {
+		return 0, os.ErrClosed
+	}
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(d, m.b[off:])
+	if n < len(d) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) Finalize() error {
+	return nil
+}
+
+func (m *memFile) Release() error {
+	m.mu.Lock()
+	m.b = nil
+	m.released = true
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,166 @@
+package hls
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+func TestDiskStoreCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls-cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keep := []string{"cam", "cam-1.ts", "camera.log", "cam-1.ts.123", "cam-.x.hls-segment", "cam1.ts.123.hls-segment"}
+	remove := []string{"cam-1.ts.123.hls-segment", "cam-probe.4567.hls-segment"}
+	for _, name := range append(keep, remove...) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (DiskStore{Dir: dir}).Cleanup(); err == nil {
+		t.Error("expected an error without a prefix")
+	}
+	if err := (DiskStore{Dir: dir, Prefix: "cam"}).Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range keep {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed", name)
+		}
+	}
+	for _, name := range remove {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+}
+
+func TestDiskStoreSharedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cam := DiskStore{Dir: dir, Prefix: "cam"}
+	camera := DiskStore{Dir: dir, Prefix: "camera"}
+	for _, d := range []DiskStore{cam, camera} {
+		f, err := d.Create("1.ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(f.(diskFile).Name())
+		f.Release()
+		other := cam
+		if d == cam {
+			other = camera
+		}
+		if !d.owns(name) {
+			t.Errorf("%s: store %q doesn't recognize its own file", name, d.Prefix)
+		}
+		if other.owns(name) {
+			t.Errorf("%s: store %q claims a file of store %q", name, other.Prefix, d.Prefix)
+		}
+		// leave the file behind as if after a crash
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cam.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !camera.owns(files[0].Name()) {
+		t.Errorf("expected only the file of store \"camera\" to remain, got %d files", len(files))
+	}
+}
+
+var errStoreFull = errors.New("store is full")
+
+// store whose first file fails after its header is written, and whose later files work
+type failingStore struct {
+	mu    sync.Mutex
+	files int
+}
+
+func (s *failingStore) Create(name string) (SegmentFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files++
+	if s.files == 1 {
+		return new(failingFile), nil
+	}
+	return MemoryStore{}.Create(name)
+}
+
+type failingFile struct {
+	writes int
+}
+
+func (f *failingFile) Write(d []byte) (int, error) {
+	f.writes++
+	if f.writes > 1 {
+		return 0, errStoreFull
+	}
+	return len(d), nil
+}
+
+func (f *failingFile) ReadAt([]byte, int64) (int, error) { return 0, io.EOF }
+func (f *failingFile) Finalize() error                   { return nil }
+func (f *failingFile) Release() error                    { return nil }
+
+func TestStoreWriteError(t *testing.T) {
+	for _, queue := range []int{0, 16} {
+		p := &Publisher{Store: new(failingStore), WriteQueue: queue}
+		src := hlstest.Source{Duration: 20 * time.Second}
+		streams, err := src.Streams()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.WriteHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+		var errs int
+		for _, pkt := range src.Packets() {
+			if err := p.WritePacket(pkt); err != nil {
+				errs++
+				if !strings.Contains(err.Error(), errStoreFull.Error()) {
+					t.Errorf("WriteQueue=%d: expected the store's error, got %v", queue, err)
+				}
+			}
+		}
+		if err := p.WriteTrailer(); err != nil {
+			t.Errorf("WriteQueue=%d: %v", queue, err)
+		}
+		if errs != 1 {
+			t.Errorf("WriteQueue=%d: got %d errors, expected only the failing segment's", queue, errs)
+		}
+		if m := p.Metrics(); m.QueueDepth != 0 {
+			t.Errorf("WriteQueue=%d: %d writes still queued after the error", queue, m.QueueDepth)
+		}
+		// the broken segment is skipped and the stream carries on after it
+		pl := string(p.Playlist())
+		if n := strings.Count(pl, "#EXT-X-GAP\n"); n != 1 {
+			t.Errorf("WriteQueue=%d: expected one gap, got %d", queue, n)
+		}
+		if i := strings.Index(pl, "#EXTINF:"); i < 0 || !strings.HasSuffix(pl[:i], "#EXT-X-GAP\n") {
+			t.Errorf("WriteQueue=%d: first segment isn't marked as a gap", queue)
+		}
+		if n := len(extinfs(t, p.Playlist())); n < 3 {
+			t.Errorf("WriteQueue=%d: only %d segments were published", queue, n)
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package hls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"eaglesong.dev/hls/hlstest"
+)
+
+// many clients stream the live segment while it is written and then trimmed from the playlist
+func TestManyReadersOfLiveSegment(t *testing.T) {
+	p := &Publisher{InMemory: true, Prefetch: true, InitialDuration: time.Second, MaxSegments: 3}
+	defer p.Close()
+	src := hlstest.Source{KeyframeInterval: time.Second, Duration: 10 * time.Second}
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	pkts := src.Packets()
+	// write into the third segment, so the one being read is still in progress
+	split := len(pkts) / 4
+	for _, pkt := range pkts[:split] {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segs := p.Segments()
+	live := segs[len(segs)-1].Name
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	const readers = 50
+	bodies := make([][]byte, readers)
+	var wg sync.WaitGroup
+	wg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/" + live)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("reader %d: status %d", i, resp.StatusCode)
+				return
+			}
+			bodies[i], err = ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("reader %d: %v", i, err)
+			}
+		}(i)
+	}
+	for i, pkt := range pkts[split:] {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			// give the readers a chance to catch up mid-segment
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := p.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for _, seg := range p.Segments() {
+		if seg.Name == live {
+			t.Fatalf("%s is still listed, expected it to be trimmed while being read", live)
+		}
+	}
+	if len(bodies[0]) == 0 {
+		t.Fatal("reader 0 got an empty segment")
+	}
+	for i, body := range bodies[1:] {
+		if !bytes.Equal(body, bodies[0]) {
+			t.Errorf("reader %d got %d bytes, expected the same %d bytes as reader 0", i+1, len(body), len(bodies[0]))
+		}
+	}
+}
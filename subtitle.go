@@ -0,0 +1,147 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubtitlePublisher serves a WebVTT subtitle rendition, segmented on the same boundaries as a video Publisher.
+//
+// Cue times use the same timeline as the video's packet timestamps. Cues are kept until the video segments they overlap
+// leave the playlist, and may be added at any time up until the segment containing them is complete.
+type SubtitlePublisher struct {
+	// Video is the publisher whose segments the subtitles follow
+	Video *Publisher
+
+	mu   sync.Mutex
+	cues []cue
+}
+
+type cue struct {
+	start, end time.Duration
+	text       string
+}
+
+// AddCue adds a subtitle shown from start until end. It is safe to call concurrently with serving.
+func (s *SubtitlePublisher) AddCue(start, end time.Duration, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.Video.state.Load().(hlsState); ok && state.listed != 0 {
+		// forget cues that ended before the oldest segment
+		oldest := state.segments[0].start
+		i := 0
+		for i < len(s.cues) && s.cues[i].end < oldest {
+			i++
+		}
+		s.cues = s.cues[i:]
+	}
+	s.cues = append(s.cues, cue{start: start, end: end, text: text})
+}
+
+// the complete video segments, which are the ones subtitles are published for
+func completeSegments(state hlsState) []*segment {
+	var segs []*segment
+	for _, seg := range state.segments[:state.listed] {
+		seg.mu.Lock()
+		final := seg.final
+		seg.mu.Unlock()
+		if !final {
+			break
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// subtitle segment name for a video segment
+func vttName(seg *segment) string {
+	return strings.TrimSuffix(seg.name, path.Ext(seg.name)) + ".vtt"
+}
+
+// build the subtitle media playlist
+func (s *SubtitlePublisher) playlist(state hlsState) []byte {
+	segs := completeSegments(state)
+	if len(segs) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", int(state.targetDur.Seconds()))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	if state.dcnseq != 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", state.dcnseq)
+	}
+	for _, seg := range segs {
+		if seg.dcn {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", formatSeconds(seg.dur), vttName(seg))
+	}
+	if state.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+// render the cues overlapping a video segment
+func (s *SubtitlePublisher) render(seg *segment) []byte {
+	var b bytes.Buffer
+	// cue times are media timestamps, which map directly onto the video's presentation timestamps
+	b.WriteString("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n")
+	end := seg.start + seg.dur
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.cues {
+		if c.end <= seg.start || c.start >= end {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", vttTime(c.start), vttTime(c.end), c.text)
+	}
+	return b.Bytes()
+}
+
+func vttTime(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// serve the subtitle playlist and segments
+func (s *SubtitlePublisher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s.Video.setCORS(rw, req) && req.Method == http.MethodOptions {
+		// preflight
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	state, ok := s.Video.state.Load().(hlsState)
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	bn := path.Base(req.URL.Path)
+	if bn == "index.m3u8" {
+		b := s.playlist(state)
+		if b == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", s.Video.playlistContentType())
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Write(b)
+		return
+	}
+	for _, seg := range completeSegments(state) {
+		if vttName(seg) == bn {
+			rw.Header().Set("Content-Type", "text/vtt")
+			rw.Write(s.render(seg))
+			return
+		}
+	}
+	http.NotFound(rw, req)
+}
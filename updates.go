@@ -0,0 +1,56 @@
+package hls
+
+// PlaylistUpdate is sent to subscribers each time a new segment starts
+type PlaylistUpdate struct {
+	// MediaSequence is the sequence number of the first segment in the playlist
+	MediaSequence int64
+	// Completed is the segment that just finished, or has an empty Name if this is the first segment
+	Completed SegmentInfo
+	// Started is the new live segment
+	Started SegmentInfo
+}
+
+// Updates returns a channel that receives an update each time a new segment starts.
+// Updates are dropped rather than blocking the writer if the receiver falls behind.
+// The channel is closed when the publisher is closed.
+func (p *Publisher) Updates() <-chan PlaylistUpdate {
+	ch := make(chan PlaylistUpdate, 16)
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	if p.subsClosed {
+		close(ch)
+		return ch
+	}
+	p.subs = append(p.subs, ch)
+	return ch
+}
+
+// notify subscribers of a new segment
+func (p *Publisher) notify(prev, started *segment) {
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	if len(p.subs) == 0 {
+		return
+	}
+	u := PlaylistUpdate{MediaSequence: p.seq, Started: started.info()}
+	if prev != nil {
+		u.Completed = prev.info()
+	}
+	for _, ch := range p.subs {
+		select {
+		case ch <- u:
+		default:
+		}
+	}
+}
+
+// close all subscriber channels
+func (p *Publisher) closeSubs() {
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	for _, ch := range p.subs {
+		close(ch)
+	}
+	p.subs = nil
+	p.subsClosed = true
+}
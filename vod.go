@@ -0,0 +1,109 @@
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ExportVOD writes the completed segments currently in the playlist to dir as a standalone VOD playlist, suitable for
+// static hosting. Segments are renumbered from zero, and the playlist is written under the same name it is served as.
+//
+// Only what is still buffered can be exported, so BufferLength must be long enough to hold the whole event, or
+// PlaylistType set to EVENT. The segments are copied without holding up writing packets or serving clients.
+func (p *Publisher) ExportVOD(dir string) error {
+	p.mu.Lock()
+	if !p.started {
+		p.mu.Unlock()
+		return errors.New("WriteHeader has not been called")
+	}
+	var segs []*segment
+	for _, seg := range p.segments {
+		// hold a reference so the contents outlive the segment being trimmed during the export
+		if seg.final && seg.acquire() {
+			segs = append(segs, seg)
+		}
+	}
+	version, independent, encrypted := p.version(), p.independentSegments(), p.block != nil
+	p.mu.Unlock()
+	defer func() {
+		for _, seg := range segs {
+			seg.unref()
+		}
+	}()
+	if len(segs) == 0 {
+		return errors.New("no completed segments to export")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	var maxDur time.Duration
+	for _, seg := range segs {
+		if seg.dur > maxDur {
+			maxDur = seg.dur
+		}
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", version, int(ceilSeconds(maxDur).Seconds()))
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	if independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	var init *initSegment
+	for i, seg := range segs {
+		name := strconv.Itoa(i) + path.Ext(seg.name)
+		if err := seg.export(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		if i != 0 && seg.dcn {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.init != nil && seg.init != init {
+			if err := ioutil.WriteFile(filepath.Join(dir, seg.init.name), seg.init.data, 0644); err != nil {
+				return err
+			}
+			b.WriteString(mapTag(init, seg.init))
+			init = seg.init
+		}
+		if encrypted {
+			// the IV is always explicit, so it still matches after renumbering
+			b.WriteString(p.Encryption.keyTag(seg.seq))
+		}
+		if !seg.ptime.IsZero() {
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + seg.ptime.UTC().Format("2006-01-02T15:04:05.999Z07:00") + "\n")
+		}
+		b.WriteString(seg.cue)
+		if seg.gap {
+			b.WriteString("#EXT-X-GAP\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", formatSeconds(seg.dur), name)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return ioutil.WriteFile(filepath.Join(dir, p.PlaylistName()), b.Bytes(), 0644)
+}
+
+// copy a completed segment's contents to a file
+func (s *segment) export(filename string) error {
+	s.mu.Lock()
+	buf, size := s.buf, s.size
+	s.mu.Unlock()
+	if buf == nil {
+		return errors.New("segment has been released")
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(buf, 0, size)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}